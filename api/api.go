@@ -5,10 +5,27 @@ import (
 )
 
 type LogEntry struct {
-	Timestamp   time.Time
-	Hostname    string
-	Application string
-	Message     string
+	ID             int64 `json:",omitempty"`
+	Timestamp      time.Time
+	Hostname       string
+	Application    string
+	Message        string
+	Priority       int
+	Facility       int
+	Severity       int
+	ProcID         string   `json:",omitempty"`
+	MsgID          string   `json:",omitempty"`
+	StructuredData string   `json:",omitempty"`
+	Matches        []*Match `json:",omitempty"`
+	Snippet        string   `json:",omitempty"`
+	SnippetMatches []*Match `json:",omitempty"`
+}
+
+// Match is the range of characters [Start, End) matching the search, in the
+// Message or Snippet of a LogEntry.
+type Match struct {
+	Start int
+	End   int
 }
 
 type QueryRequest struct {
@@ -17,8 +34,19 @@ type QueryRequest struct {
 	Hostname      string
 	Application   string
 	Message       string
+	Query         string
+	Severity      string
+	Facility      string
+	ProcID        string
+	MsgID         string
+	Interval      string
+	GroupBy       string
+	Sort          string
+	Cursor        string
 	Limit         int
 	Offset        int
+	Highlight     bool
+	Snippet       bool
 }
 
 type QueryStatResponse struct {
@@ -27,10 +55,68 @@ type QueryStatResponse struct {
 }
 
 type QueryListResponse struct {
+	Entries    []*LogEntry `json:",omitempty"`
+	PrevCursor string      `json:",omitempty"`
+	NextCursor string      `json:",omitempty"`
+	Error      string      `json:",omitempty"`
+}
+
+type QueryContextRequest struct {
+	ID     int64
+	Before int
+	After  int
+}
+
+type QueryContextResponse struct {
 	Entries []*LogEntry `json:",omitempty"`
 	Error   string      `json:",omitempty"`
 }
 
+type HistogramBucket struct {
+	Timestamp time.Time
+	Count     uint64
+}
+
+type QueryHistogramResponse struct {
+	Interval  string                        `json:",omitempty"`
+	Histogram map[string][]*HistogramBucket `json:",omitempty"`
+	Error     string                        `json:",omitempty"`
+}
+
+// Archive is a file of entries deleted by the retention, from
+// FromTimestamp to ToTimestamp (both included).
+type Archive struct {
+	Name          string
+	Created       time.Time
+	FromTimestamp time.Time
+	ToTimestamp   time.Time
+	Entries       int64
+	Size          int64
+}
+
+type ArchiveListResponse struct {
+	Archives []*Archive `json:",omitempty"`
+	Error    string     `json:",omitempty"`
+}
+
+type BackupRequest struct {
+	Compress bool
+}
+
+// Backup is a consistent snapshot of the database files, taken while the
+// entries are still being inserted.
+type Backup struct {
+	Name    string
+	Created time.Time
+	Files   []string
+	Size    int64
+}
+
+type BackupResponse struct {
+	Backup *Backup `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
 type InsertRequest struct {
 	Entry   *LogEntry
 	Entries []*LogEntry
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var archivedEntries = metrics.GetCounter("raftman_backend_archived_entries_total", "Number of entries archived before being deleted by the retention.")
+
+const archiveManifest = "manifest.json"
+
+// archiver writes the entries deleted by the retention to gzipped newline
+// delimited JSON files in a directory, and lists them in its manifest once
+// they are complete.
+type archiver struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func openArchiver(dir string) (*archiver, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &archiver{dir: dir}, nil
+}
+
+// archiveWriter writes an archive file.
+type archiveWriter struct {
+	a       *archiver
+	f       *os.File
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	archive api.Archive
+}
+
+// create starts a new archive named name, or name-2, name-3, ... if it is
+// already taken.
+func (a *archiver) create(name string) (*archiveWriter, error) {
+
+	path := filepath.Join(a.dir, name+".jsonl.gz")
+	for i := 2; ; i++ {
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		path = filepath.Join(a.dir, fmt.Sprintf("%s-%d.jsonl.gz", name, i))
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(f)
+	return &archiveWriter{a: a, f: f, gz: gz, enc: json.NewEncoder(gz),
+		archive: api.Archive{Name: filepath.Base(path), Created: time.Now().UTC()}}, nil
+}
+
+func (w *archiveWriter) write(e *api.LogEntry) error {
+	archived := *e
+	archived.ID = 0
+	if err := w.enc.Encode(&archived); err != nil {
+		return err
+	}
+	if w.archive.Entries == 0 || e.Timestamp.Before(w.archive.FromTimestamp) {
+		w.archive.FromTimestamp = e.Timestamp
+	}
+	if w.archive.Entries == 0 || e.Timestamp.After(w.archive.ToTimestamp) {
+		w.archive.ToTimestamp = e.Timestamp
+	}
+	w.archive.Entries++
+	return nil
+}
+
+// sync makes sure what is written so far is on disk, before the entries are
+// deleted.
+func (w *archiveWriter) sync() error {
+	if err := w.gz.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// close completes the archive, and adds it to the manifest.
+func (w *archiveWriter) close() (*api.Archive, error) {
+	if err := w.gz.Close(); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	w.archive.Size = info.Size()
+	if err = w.f.Close(); err != nil {
+		return nil, err
+	}
+	archivedEntries.Add(uint64(w.archive.Entries))
+	return &w.archive, w.a.add(&w.archive)
+}
+
+// abort removes an archive whose entries were not deleted.
+func (w *archiveWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// list returns the archives of the manifest.
+func (a *archiver) list() ([]*api.Archive, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.read()
+}
+
+func (a *archiver) read() ([]*api.Archive, error) {
+	data, err := ioutil.ReadFile(filepath.Join(a.dir, archiveManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var archives []*api.Archive
+	if err = json.Unmarshal(data, &archives); err != nil {
+		return nil, fmt.Errorf("Invalid archive manifest: %s", err)
+	}
+	return archives, nil
+}
+
+func (a *archiver) add(archive *api.Archive) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	archives, err := a.read()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(archives, archive), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(a.dir, archiveManifest+".tmp")
+	if err = ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(a.dir, archiveManifest))
+}
+
+// archivePartition archives all the entries of a partition, oldest first.
+func (a *archiver) archivePartition(p *partition) (*api.Archive, error) {
+
+	ext := filepath.Ext(p.path)
+	w, err := a.create(strings.TrimSuffix(filepath.Base(p.path), ext))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query("SELECT " + sqlArchiveColumns + " FROM logh AS h JOIN logb AS b ON b.rowid = h.rowid ORDER BY h.ts, h.rowid")
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	defer rows.Close()
+
+	err = writeArchiveRows(w, rows)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w.close()
+}
+
+const sqlArchiveColumns = "h.ts, h.host, h.app, b.msg, h.prio, h.fac, h.sev, h.procid, h.msgid, h.sd"
+
+// writeArchiveRows writes the entries of rows selecting sqlArchiveColumns.
+func writeArchiveRows(w *archiveWriter, rows *sql.Rows) error {
+	for rows.Next() {
+		entry := api.LogEntry{}
+		err := rows.Scan(&entry.Timestamp, &entry.Hostname, &entry.Application, &entry.Message,
+			&entry.Priority, &entry.Facility, &entry.Severity, &entry.ProcID, &entry.MsgID, &entry.StructuredData)
+		if err != nil {
+			return err
+		}
+		if err = w.write(&entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
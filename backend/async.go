@@ -1,8 +1,10 @@
 package backend
 
 import (
+	"context"
 	"fmt"
 	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
 	"github.com/pierredavidbelanger/raftman/utils"
 	"net/url"
 	"sync"
@@ -10,61 +12,168 @@ import (
 )
 
 type queryStatM struct {
+	ctx context.Context
 	req *api.QueryRequest
 	res chan *api.QueryStatResponse
 }
 
-func newQueryStatM(req *api.QueryRequest) *queryStatM {
-	return &queryStatM{req, make(chan *api.QueryStatResponse, 1)}
+func newQueryStatM(ctx context.Context, req *api.QueryRequest) *queryStatM {
+	return &queryStatM{ctx, req, make(chan *api.QueryStatResponse, 1)}
 }
 
 func (m *queryStatM) push(c chan *queryStatM) *queryStatM {
-	c <- m
+	select {
+	case c <- m:
+	case <-m.ctx.Done():
+	}
 	return m
 }
 
-func (m *queryStatM) pollWithTimeout(d time.Duration) (*api.QueryStatResponse, error) {
-	t := time.NewTimer(d)
+func (m *queryStatM) poll() (*api.QueryStatResponse, error) {
 	select {
 	case v := <-m.res:
 		return v, nil
-	case <-t.C:
-		return nil, fmt.Errorf("operation timed out after %s", d)
+	case <-m.ctx.Done():
+		return nil, ctxError(m.ctx)
 	}
 }
 
 type queryListM struct {
-	req *api.QueryRequest
-	res chan *api.QueryListResponse
+	ctx      context.Context
+	req      *api.QueryRequest
+	maxLimit int
+	res      chan *api.QueryListResponse
 }
 
-func newQueryListM(req *api.QueryRequest) *queryListM {
-	return &queryListM{req, make(chan *api.QueryListResponse, 1)}
+func newQueryListM(ctx context.Context, req *api.QueryRequest, maxLimit int) *queryListM {
+	return &queryListM{ctx, req, maxLimit, make(chan *api.QueryListResponse, 1)}
 }
 
 func (m *queryListM) push(c chan *queryListM) *queryListM {
-	c <- m
+	select {
+	case c <- m:
+	case <-m.ctx.Done():
+	}
+	return m
+}
+
+func (m *queryListM) poll() (*api.QueryListResponse, error) {
+	select {
+	case v := <-m.res:
+		return v, nil
+	case <-m.ctx.Done():
+		return nil, ctxError(m.ctx)
+	}
+}
+
+type queryHistogramM struct {
+	ctx context.Context
+	req *api.QueryRequest
+	res chan *api.QueryHistogramResponse
+}
+
+func newQueryHistogramM(ctx context.Context, req *api.QueryRequest) *queryHistogramM {
+	return &queryHistogramM{ctx, req, make(chan *api.QueryHistogramResponse, 1)}
+}
+
+func (m *queryHistogramM) push(c chan *queryHistogramM) *queryHistogramM {
+	select {
+	case c <- m:
+	case <-m.ctx.Done():
+	}
+	return m
+}
+
+func (m *queryHistogramM) poll() (*api.QueryHistogramResponse, error) {
+	select {
+	case v := <-m.res:
+		return v, nil
+	case <-m.ctx.Done():
+		return nil, ctxError(m.ctx)
+	}
+}
+
+type queryContextM struct {
+	ctx context.Context
+	req *api.QueryContextRequest
+	res chan *api.QueryContextResponse
+}
+
+func newQueryContextM(ctx context.Context, req *api.QueryContextRequest) *queryContextM {
+	return &queryContextM{ctx, req, make(chan *api.QueryContextResponse, 1)}
+}
+
+func (m *queryContextM) push(c chan *queryContextM) *queryContextM {
+	select {
+	case c <- m:
+	case <-m.ctx.Done():
+	}
 	return m
 }
 
-func (m *queryListM) pollWithTimeout(d time.Duration) (*api.QueryListResponse, error) {
-	t := time.NewTimer(d)
+func (m *queryContextM) poll() (*api.QueryContextResponse, error) {
 	select {
 	case v := <-m.res:
 		return v, nil
-	case <-t.C:
-		return nil, fmt.Errorf("operation timed out after %s", d)
+	case <-m.ctx.Done():
+		return nil, ctxError(m.ctx)
 	}
 }
 
+// ctxError returns the error of a done context, worded for the API.
+func ctxError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("operation timed out")
+	}
+	return ctx.Err()
+}
+
+type tailM struct {
+	req     *api.QueryRequest
+	entries chan *api.LogEntry
+	lastIDs map[int64]int64
+	closeQ  chan *tailM
+	once    sync.Once
+}
+
+func newTailM(req *api.QueryRequest, size int, closeQ chan *tailM) *tailM {
+	return &tailM{req: req, entries: make(chan *api.LogEntry, size), closeQ: closeQ}
+}
+
+func (m *tailM) push(c chan *tailM) *tailM {
+	c <- m
+	return m
+}
+
+func (m *tailM) Entries() <-chan *api.LogEntry {
+	return m.entries
+}
+
+func (m *tailM) Close() error {
+	m.once.Do(func() {
+		m.closeQ <- m
+	})
+	return nil
+}
+
 type asyncBackend struct {
-	insertQ    chan *api.LogEntry
-	queryStatQ chan *queryStatM
-	queryListQ chan *queryListM
-	stopQ      chan *sync.Cond
-	timeout    time.Duration
+	insertQ         chan *api.LogEntry
+	queryStatQ      chan *queryStatM
+	queryListQ      chan *queryListM
+	queryHistogramQ chan *queryHistogramM
+	queryContextQ   chan *queryContextM
+	tailQ           chan *tailM
+	untailQ         chan *tailM
+	stopQ           chan *sync.Cond
+	timeout         time.Duration
+	shutdownTimeout time.Duration
+	tailQueueSize   int
+	exportBatchSize int
+	overflow        overflowQueue
 }
 
+var asyncBackendParams = []string{"insertQueueSize", "queryQueueSize", "timeout", "shutdownTimeout", "tailQueueSize", "exportBatchSize", "overflow", "sampleRate"}
+
 func initAsyncBackend(backendURL *url.URL, b *asyncBackend) error {
 	insertQueueSize, err := utils.GetIntQueryParam(backendURL, "insertQueueSize", 512)
 	if err != nil {
@@ -78,10 +187,58 @@ func initAsyncBackend(backendURL *url.URL, b *asyncBackend) error {
 	if err != nil {
 		return err
 	}
+	shutdownTimeout, err := utils.GetDurationQueryParam(backendURL, "shutdownTimeout", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	tailQueueSize, err := utils.GetIntQueryParam(backendURL, "tailQueueSize", 256)
+	if err != nil {
+		return err
+	}
+	exportBatchSize, err := utils.GetIntQueryParam(backendURL, "exportBatchSize", 1024)
+	if err != nil {
+		return err
+	}
+	overflow, err := getOverflowQueryParam(backendURL, "overflow", overflowBlock)
+	if err != nil {
+		return err
+	}
+	sampleRate, err := utils.GetIntQueryParam(backendURL, "sampleRate", 10)
+	if err != nil {
+		return err
+	}
+	if sampleRate < 1 {
+		return fmt.Errorf("Invalid sampleRate '%d', must be at least 1", sampleRate)
+	}
 	b.insertQ = make(chan *api.LogEntry, insertQueueSize)
 	b.queryStatQ = make(chan *queryStatM, queryQueueSize)
 	b.queryListQ = make(chan *queryListM, queryQueueSize)
+	b.queryHistogramQ = make(chan *queryHistogramM, queryQueueSize)
+	b.queryContextQ = make(chan *queryContextM, queryQueueSize)
+	b.tailQ = make(chan *tailM, queryQueueSize)
+	b.untailQ = make(chan *tailM, queryQueueSize)
 	b.stopQ = make(chan *sync.Cond, 1)
 	b.timeout = timeout
+	b.shutdownTimeout = shutdownTimeout
+	b.tailQueueSize = tailQueueSize
+	b.exportBatchSize = exportBatchSize
+	b.overflow.policy = overflow
+	b.overflow.sampleRate = sampleRate
 	return nil
 }
+
+func (b *asyncBackend) registerQueueMetrics() {
+	for name, q := range map[string]func() (int, int){
+		"insert":          func() (int, int) { return len(b.insertQ), cap(b.insertQ) },
+		"query_stat":      func() (int, int) { return len(b.queryStatQ), cap(b.queryStatQ) },
+		"query_list":      func() (int, int) { return len(b.queryListQ), cap(b.queryListQ) },
+		"query_histogram": func() (int, int) { return len(b.queryHistogramQ), cap(b.queryHistogramQ) },
+		"query_context":   func() (int, int) { return len(b.queryContextQ), cap(b.queryContextQ) },
+	} {
+		q := q
+		metrics.SetGaugeFunc("raftman_backend_queue_length", "Number of messages waiting in a backend queue.",
+			func() float64 { l, _ := q(); return float64(l) }, "queue", name)
+		metrics.SetGaugeFunc("raftman_backend_queue_capacity", "Capacity of a backend queue.",
+			func() float64 { _, c := q(); return float64(c) }, "queue", name)
+	}
+}
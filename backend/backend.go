@@ -13,3 +13,17 @@ func NewBackend(e spi.LogEngine, backendURL *url.URL) (spi.LogBackend, error) {
 	}
 	return nil, fmt.Errorf("Invalid backend %s", backendURL.Scheme)
 }
+
+// Restore puts back the database files of a backup, while the backend is
+// stopped.
+func Restore(backendURL *url.URL, dir string) error {
+	switch backendURL.Scheme {
+	case "sqlite":
+		b, err := newSQLiteBackend(backendURL)
+		if err != nil {
+			return err
+		}
+		return b.restore(dir)
+	}
+	return fmt.Errorf("Invalid backend %s", backendURL.Scheme)
+}
@@ -0,0 +1,291 @@
+package backend
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pierredavidbelanger/raftman/api"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup copies every partition with the SQLite online backup API to a new
+// directory of the backup directory. The insertions go on meanwhile, and the
+// partitions are not removed until their copy is done.
+func (b *sqliteBackend) Backup(ctx context.Context, req *api.BackupRequest) (*api.BackupResponse, error) {
+
+	if b.backupDir == "" {
+		return nil, fmt.Errorf("backup is disabled")
+	}
+
+	start := time.Now()
+	backup := api.Backup{Created: start.UTC()}
+
+	err := os.MkdirAll(b.backupDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// The backup is written to a temporary directory, so that an incomplete
+	// one is never taken for a complete one
+	tmp, err := ioutil.TempDir(b.backupDir, ".backup-")
+	if err != nil {
+		return nil, err
+	}
+
+	parts := b.acquirePartitions(time.Time{}, time.Time{})
+	defer releasePartitions(parts)
+
+	for _, p := range parts {
+		file, size, err := backupPartition(ctx, p, tmp, req.Compress)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return nil, fmt.Errorf("Unable to backup '%s': %s", p.path, err)
+		}
+		backup.Files = append(backup.Files, file)
+		backup.Size += size
+	}
+
+	name := "backup-" + backup.Created.Format("20060102T150405Z")
+	path := filepath.Join(b.backupDir, name)
+	for i := 2; ; i++ {
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(b.backupDir, fmt.Sprintf("%s-%d", name, i))
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	backup.Name = filepath.Base(path)
+
+	log.Printf("Backed up %d database files to '%s' in %s", len(backup.Files), path, time.Since(start).Round(time.Millisecond))
+
+	return &api.BackupResponse{Backup: &backup}, nil
+}
+
+// backupPartition copies the partition to dir, gzipped if compress, and
+// returns the name and size of the copy.
+func backupPartition(ctx context.Context, p *partition, dir string, compress bool) (string, int64, error) {
+
+	path := filepath.Join(dir, filepath.Base(p.path))
+	if err := backupDatabase(ctx, p.rdb, path); err != nil {
+		return "", 0, err
+	}
+
+	if compress {
+		err := gzipFile(path, path+".gz")
+		os.Remove(path)
+		if err != nil {
+			return "", 0, err
+		}
+		path += ".gz"
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return filepath.Base(path), info.Size(), nil
+}
+
+// backupDatabase copies src to a new database file at path, in a single step:
+// the copy is done in one read transaction, so it is consistent, and as the
+// database is in WAL mode, the writer does not wait for it.
+func backupDatabase(ctx context.Context, src *sql.DB, path string) error {
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			bk, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			_, err = bk.Step(-1)
+			if err != nil {
+				bk.Finish()
+				return err
+			}
+			return bk.Finish()
+		})
+	})
+}
+
+func gzipFile(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// restore puts the database files of the backup in dir next to the database
+// file path, which must not have any yet. The files of a partitioned backup
+// keep their partition name, so a backup can be restored under another
+// database file name.
+func (b *sqliteBackend) restore(dir string) error {
+
+	existing, err := b.findPartitions()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("Unable to restore, the database file '%s' already exists", existing[0].path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	var files [][2]string
+	targets := make(map[string]string)
+	for _, path := range paths {
+		file := strings.TrimSuffix(filepath.Base(path), ".gz")
+		ext := filepath.Ext(file)
+		stem := strings.TrimSuffix(file, ext)
+		target := b.dbFilePath
+		if p, start, ok := parsePartitionSuffix(stem); ok {
+			target = partitionPath(b.dbFilePath, p.name(start))
+		}
+		if other, ok := targets[target]; ok {
+			return fmt.Errorf("Invalid backup '%s', both '%s' and '%s' would be restored to '%s'", dir, other, path, target)
+		}
+		targets[target] = path
+		files = append(files, [2]string{path, target})
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("Invalid backup '%s', it has no database file", dir)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(b.dbFilePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err = restoreFile(f[0], f[1]); err != nil {
+			return fmt.Errorf("Unable to restore '%s': %s", f[0], err)
+		}
+		log.Printf("Restored '%s' to '%s'", f[0], f[1])
+	}
+
+	return nil
+}
+
+// parsePartitionSuffix returns the partitioning and the start of the
+// partition named at the end of a database file stem, after the last dash
+// of the day (ie: logs-2017-06-01) or week (ie: logs-2017-W22) name, so the
+// database file name may have dashes of its own.
+func parsePartitionSuffix(stem string) (partitioning, time.Time, bool) {
+	for _, n := range []int{len("2006-01-02"), len("2006-W01")} {
+		if len(stem) > n && stem[len(stem)-n-1] == '-' {
+			if p, start, ok := parsePartitionName(stem[len(stem)-n:]); ok {
+				return p, start, true
+			}
+		}
+	}
+	return partitionNone, time.Time{}, false
+}
+
+// restoreFile copies src to dst, gunzipping it if needed, and checks that
+// the copy is a sound database before giving it its name.
+func restoreFile(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if strings.HasSuffix(src, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = checkDatabase(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// checkDatabase checks a database file, with a read-write connection so that
+// it does not leave its WAL files behind.
+func checkDatabase(path string) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err = db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("Invalid database: %s", result)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// cursor is a position in a list of entries sorted by (ts, ID), or by
+// (rank, ID) for the relevance. It is handed to clients as an opaque
+// string to fetch the entries before or after that position. When sorted by
+// time, it is stable no matter how many entries are inserted.
+type cursor struct {
+	Before bool    `json:"b,omitempty"`
+	TS     string  `json:"t"`
+	ID     int64   `json:"r"`
+	Rank   float64 `json:"k,omitempty"`
+}
+
+func (c *cursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s'", s)
+	}
+	c := cursor{}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor '%s'", s)
+	}
+	return &c, nil
+}
+
+// less reports if the cursor comes before o in the given order.
+func (c *cursor) less(o *cursor, relevance, asc bool) bool {
+	switch {
+	case relevance && asc:
+		return c.Rank < o.Rank || (c.Rank == o.Rank && c.ID > o.ID)
+	case relevance:
+		return c.Rank > o.Rank || (c.Rank == o.Rank && c.ID < o.ID)
+	case asc:
+		return c.TS < o.TS || (c.TS == o.TS && c.ID < o.ID)
+	}
+	return c.TS > o.TS || (c.TS == o.TS && c.ID > o.ID)
+}
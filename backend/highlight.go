@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"github.com/pierredavidbelanger/raftman/api"
+	"strings"
+)
+
+// The FTS5 highlight() and snippet() functions surround the matches with
+// those characters, from the Unicode private use area, which are then
+// turned into match ranges.
+const (
+	matchOpen  = '\ue000'
+	matchClose = '\ue001'
+)
+
+// sqlRank is the FTS5 relevance of an entry, the lower the better.
+const sqlRank = "bm25(b.logb)"
+
+const (
+	sqlHighlight = "highlight(b.logb, 0, char(57344), char(57345))"
+	sqlSnippet   = "snippet(b.logb, 0, char(57344), char(57345), '…', 16)"
+)
+
+// parseMarkedMatches removes the match markers from s, and returns what is
+// left with the ranges of characters that were between the markers.
+func parseMarkedMatches(s string) (string, []*api.Match) {
+	if !strings.ContainsRune(s, matchOpen) {
+		return s, nil
+	}
+	var buf strings.Builder
+	var matches []*api.Match
+	var m *api.Match
+	n := 0
+	for _, r := range s {
+		switch r {
+		case matchOpen:
+			m = &api.Match{Start: n}
+		case matchClose:
+			if m != nil {
+				m.End = n
+				matches = append(matches, m)
+				m = nil
+			}
+		default:
+			buf.WriteRune(r)
+			n++
+		}
+	}
+	return buf.String(), matches
+}
@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type overflowPolicy int
+
+const (
+	overflowBlock overflowPolicy = iota
+	overflowDropNewest
+	overflowDropOldest
+	overflowSample
+)
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case overflowDropNewest:
+		return "dropNewest"
+	case overflowDropOldest:
+		return "dropOldest"
+	case overflowSample:
+		return "sample"
+	}
+	return "block"
+}
+
+func getOverflowQueryParam(u *url.URL, name string, defaultValue overflowPolicy) (overflowPolicy, error) {
+	s := u.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	for _, p := range []overflowPolicy{overflowBlock, overflowDropNewest, overflowDropOldest, overflowSample} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return defaultValue, fmt.Errorf("Invalid %s '%s', must be one of block, dropNewest, dropOldest or sample", name, s)
+}
+
+type dropKey struct {
+	host string
+	app  string
+}
+
+// overflowQueue applies the overflow policy when pushing to the insert
+// queue, and keeps count of the entries dropped per host and app.
+type overflowQueue struct {
+	policy     overflowPolicy
+	sampleRate int
+
+	mu      sync.Mutex
+	sampled int
+	dropped map[dropKey]int
+}
+
+// push puts e in q, or drops it (or an older entry) when q is full,
+// according to the policy. Only the block policy waits for room.
+func (o *overflowQueue) push(q chan *api.LogEntry, e *api.LogEntry) {
+	switch o.policy {
+	case overflowDropNewest:
+		select {
+		case q <- e:
+		default:
+			o.drop(e)
+		}
+	case overflowDropOldest:
+		o.pushDropOldest(q, e)
+	case overflowSample:
+		select {
+		case q <- e:
+			return
+		default:
+		}
+		// While the queue is full, drop the info and debug entries, and keep
+		// one of every sampleRate of the others, in place of the oldest
+		if e.Severity >= 6 {
+			o.drop(e)
+			return
+		}
+		o.mu.Lock()
+		o.sampled++
+		keep := o.sampled%o.sampleRate == 0
+		o.mu.Unlock()
+		if keep {
+			o.pushDropOldest(q, e)
+		} else {
+			o.drop(e)
+		}
+	default:
+		q <- e
+	}
+}
+
+// pushDropOldest puts e in q, dropping the oldest entries to make room.
+func (o *overflowQueue) pushDropOldest(q chan *api.LogEntry, e *api.LogEntry) {
+	for {
+		select {
+		case q <- e:
+			return
+		default:
+		}
+		select {
+		case old := <-q:
+			o.drop(old)
+		default:
+		}
+	}
+}
+
+// droppedEntries is not labelled by host and app, as they come from the
+// messages: the dropped entries of each host and app are reported by
+// takeDropped instead.
+var droppedEntries = metrics.GetCounter("raftman_backend_dropped_entries_total", "Number of entries dropped because the insert queue was full.")
+
+func (o *overflowQueue) drop(e *api.LogEntry) {
+	droppedEntries.Inc()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.dropped == nil {
+		o.dropped = make(map[dropKey]int)
+	}
+	o.dropped[dropKey{e.Hostname, e.Application}]++
+}
+
+// takeDropped returns one entry per host and app reporting how many of its
+// entries were dropped since the last call.
+func (o *overflowQueue) takeDropped() []*api.LogEntry {
+	o.mu.Lock()
+	dropped := o.dropped
+	o.dropped = nil
+	o.mu.Unlock()
+	if len(dropped) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	entries := make([]*api.LogEntry, 0, len(dropped))
+	for k, n := range dropped {
+		entries = append(entries, &api.LogEntry{
+			Timestamp:   now,
+			Hostname:    k.host,
+			Application: k.app,
+			Message:     fmt.Sprintf("raftman dropped %d messages", n),
+			Priority:    5*8 + 4,
+			Facility:    5,
+			Severity:    4,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hostname != entries[j].Hostname {
+			return entries[i].Hostname < entries[j].Hostname
+		}
+		return entries[i].Application < entries[j].Application
+	})
+	return entries
+}
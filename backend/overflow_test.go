@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"github.com/pierredavidbelanger/raftman/api"
+	"testing"
+	"time"
+)
+
+// fullTestQueue returns a full queue of two entries, from app "a0" and "a1".
+func fullTestQueue() chan *api.LogEntry {
+	q := make(chan *api.LogEntry, 2)
+	q <- &api.LogEntry{Hostname: "h", Application: "a0", Severity: 3}
+	q <- &api.LogEntry{Hostname: "h", Application: "a1", Severity: 3}
+	return q
+}
+
+// checkTestQueue checks the apps of the entries left in q, in order.
+func checkTestQueue(t *testing.T, q chan *api.LogEntry, apps ...string) {
+	t.Helper()
+	if len(q) != len(apps) {
+		t.Fatalf("Queue has %d entries, want %d", len(q), len(apps))
+	}
+	for _, app := range apps {
+		if e := <-q; e.Application != app {
+			t.Fatalf("Queue has entry from '%s', want '%s'", e.Application, app)
+		}
+	}
+}
+
+// checkTestDropped checks how many entries of each app were dropped.
+func checkTestDropped(t *testing.T, o *overflowQueue, want map[string]int) {
+	t.Helper()
+	if len(o.dropped) != len(want) {
+		t.Fatalf("Dropped entries of %v, want %v", o.dropped, want)
+	}
+	for app, n := range want {
+		if o.dropped[dropKey{"h", app}] != n {
+			t.Fatalf("Dropped entries of %v, want %v", o.dropped, want)
+		}
+	}
+}
+
+// pushTestEntry pushes an entry, and fails if the push blocks.
+func pushTestEntry(t *testing.T, o *overflowQueue, q chan *api.LogEntry, app string, severity int) {
+	t.Helper()
+	done := make(chan bool)
+	go func() {
+		o.push(q, &api.LogEntry{Hostname: "h", Application: app, Severity: severity})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Push of entry from '%s' blocked on a full queue", app)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+
+	o := &overflowQueue{policy: overflowBlock}
+	q := fullTestQueue()
+
+	done := make(chan bool)
+	go func() {
+		o.push(q, &api.LogEntry{Hostname: "h", Application: "new"})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Push did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-q
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Push did not take the room made")
+	}
+	checkTestQueue(t, q, "a1", "new")
+	checkTestDropped(t, o, nil)
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+
+	o := &overflowQueue{policy: overflowDropNewest}
+	q := fullTestQueue()
+
+	pushTestEntry(t, o, q, "new", 3)
+	checkTestQueue(t, q, "a0", "a1")
+	checkTestDropped(t, o, map[string]int{"new": 1})
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+
+	o := &overflowQueue{policy: overflowDropOldest}
+	q := fullTestQueue()
+
+	pushTestEntry(t, o, q, "new", 3)
+	checkTestQueue(t, q, "a1", "new")
+	checkTestDropped(t, o, map[string]int{"a0": 1})
+}
+
+func TestOverflowSample(t *testing.T) {
+
+	o := &overflowQueue{policy: overflowSample, sampleRate: 2}
+	q := fullTestQueue()
+
+	// Info and debug entries are all dropped
+	for i := 0; i < 4; i++ {
+		pushTestEntry(t, o, q, "debug", 7)
+		pushTestEntry(t, o, q, "info", 6)
+	}
+
+	// One of every two others is kept, in place of the oldest
+	pushTestEntry(t, o, q, "err1", 3)
+	pushTestEntry(t, o, q, "err2", 3)
+	pushTestEntry(t, o, q, "err3", 3)
+	pushTestEntry(t, o, q, "err4", 3)
+
+	checkTestQueue(t, q, "err2", "err4")
+	checkTestDropped(t, o, map[string]int{"debug": 4, "info": 4, "err1": 1, "err3": 1, "a0": 1, "a1": 1})
+
+	// With room, every entry is kept
+	pushTestEntry(t, o, q, "debug", 7)
+	checkTestQueue(t, q, "debug")
+}
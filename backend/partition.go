@@ -0,0 +1,555 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var removedPartitions = metrics.GetCounter("raftman_backend_retention_removed_partitions_total", "Number of partition files removed by the retention.")
+
+// partitioning splits the entries in one database file per period, named
+// after the database file and the period (ie: logs-2017-06-01.db for a
+// day, logs-2017-W22.db for an ISO week).
+type partitioning int
+
+const (
+	partitionNone partitioning = iota
+	partitionDay
+	partitionWeek
+)
+
+func (p partitioning) String() string {
+	switch p {
+	case partitionDay:
+		return "day"
+	case partitionWeek:
+		return "week"
+	}
+	return "none"
+}
+
+func getPartitioningQueryParam(u *url.URL, name string, defaultValue partitioning) (partitioning, error) {
+	s := u.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	for _, p := range []partitioning{partitionNone, partitionDay, partitionWeek} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return defaultValue, fmt.Errorf("Invalid %s '%s', must be one of none, day or week", name, s)
+}
+
+// partitionEpoch is the start of the first partition, a Monday so that it
+// is also the start of a week. Older entries go in the first partition.
+var partitionEpoch = time.Date(1969, 12, 29, 0, 0, 0, 0, time.UTC)
+
+// An entry ID is the key of its partition, shifted by partitionIDShift, plus
+// its rowid in the partition, so that IDs sort like the entries of a single
+// database, and fit in the 53 bits of a JavaScript number. A key is made of
+// the days from the epoch to the start of the partition, and of its kind, so
+// that a day and a week starting on the same Monday do not collide.
+const (
+	partitionIDShift = 35
+	partitionMaxDays = 1<<(53-partitionIDShift)/2 - 2
+)
+
+// start returns the start of the partition of the entries at t.
+func (p partitioning) start(t time.Time) time.Time {
+	t = t.UTC()
+	if t.Before(partitionEpoch) {
+		return partitionEpoch
+	}
+	if max := partitionEpoch.AddDate(0, 0, partitionMaxDays); t.After(max) {
+		t = max
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if p == partitionWeek {
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// end returns the end of the partition that starts at start.
+func (p partitioning) end(start time.Time) time.Time {
+	if p == partitionWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func (p partitioning) name(start time.Time) string {
+	if p == partitionWeek {
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	}
+	return start.Format("2006-01-02")
+}
+
+func (p partitioning) key(start time.Time) int64 {
+	key := 2 * ((start.Unix()-partitionEpoch.Unix())/(24*60*60) + 1)
+	if p == partitionWeek {
+		key++
+	}
+	return key
+}
+
+// parsePartitionName returns the partitioning and the start of a partition
+// name, whatever the current partitioning is.
+func parsePartitionName(name string) (partitioning, time.Time, bool) {
+	if start, err := time.Parse("2006-01-02", name); err == nil {
+		return partitionDay, start, true
+	}
+	var year, week int
+	if n, err := fmt.Sscanf(name, "%04d-W%02d", &year, &week); err == nil && n == 2 && week >= 1 && week <= 53 {
+		// The first ISO week of a year is the one with January 4th
+		jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+		start := jan4.AddDate(0, 0, (week-1)*7-(int(jan4.Weekday())+6)%7)
+		if partitionWeek.name(start) == name {
+			return partitionWeek, start, true
+		}
+	}
+	return partitionNone, time.Time{}, false
+}
+
+// partition is a database file holding the entries from from (included) to
+// to (excluded), where a zero bound is unbounded. The whole database is a
+// single unbounded partition when the backend is not partitioned.
+type partition struct {
+	key       int64
+	path      string
+	from      time.Time
+	to        time.Time
+	db        *sql.DB
+	rdb       *sql.DB
+	hStmt     *sql.Stmt
+	bStmt     *sql.Stmt
+	migration *schemaMigration
+	version   int
+	unmerged  int64
+	refs      sync.WaitGroup
+	removed   chan bool
+	kept      bool
+}
+
+// partitionPath returns the path of the partition named name, next to the
+// database file path.
+func partitionPath(dbFilePath, name string) string {
+	ext := filepath.Ext(dbFilePath)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(dbFilePath, ext), name, ext)
+}
+
+func (b *sqliteBackend) newPartition(p partitioning, start time.Time) *partition {
+	part := partition{key: p.key(start), path: partitionPath(b.dbFilePath, p.name(start)), from: start, to: p.end(start)}
+	if !start.After(partitionEpoch) {
+		part.from = time.Time{}
+	}
+	return &part
+}
+
+// findPartitions returns the partitions found next to the database file
+// path, along with the database file itself, if any, as an unbounded
+// partition (ie: the entries stored before the backend was partitioned).
+func (b *sqliteBackend) findPartitions() ([]*partition, error) {
+	ext := filepath.Ext(b.dbFilePath)
+	prefix := strings.TrimSuffix(b.dbFilePath, ext) + "-"
+	paths, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*partition
+	for _, path := range paths {
+		p, start, ok := parsePartitionName(strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext))
+		if ok {
+			parts = append(parts, b.newPartition(p, start))
+		}
+	}
+	if _, err = os.Stat(b.dbFilePath); err == nil {
+		parts = append(parts, &partition{path: b.dbFilePath})
+	}
+	return parts, nil
+}
+
+// openPartition opens the database file of the partition, creating it if
+// needed, and upgrades its schema. A new database file is migrated right
+// away, as there is nothing to migrate in the background.
+func (b *sqliteBackend) openPartition(p *partition) error {
+
+	_, err := os.Stat(p.path)
+	created := os.IsNotExist(err)
+
+	db, err := sql.Open("sqlite3", p.path)
+	if err != nil {
+		return err
+	}
+	p.db = db
+
+	// In WAL mode, the readers do not wait for the writer, and vice versa
+	_, err = db.Exec("PRAGMA journal_mode=WAL")
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	if b.vacuum {
+		err = enableIncrementalVacuum(db)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("Unable to enable incremental vacuum: %s", err)
+		}
+	}
+
+	err = p.migrateSchema()
+	if err != nil {
+		db.Close()
+		return err
+	}
+	for created && p.migration != nil {
+		p.handleSchemaMigration()
+	}
+
+	hStmt, err := db.Prepare("INSERT INTO logh (ts, host, app, prio, fac, sev, procid, msgid, sd) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		db.Close()
+		return err
+	}
+	p.hStmt = hStmt
+
+	bStmt, err := db.Prepare("INSERT INTO logb (rowid, msg) VALUES (?, ?)")
+	if err != nil {
+		hStmt.Close()
+		db.Close()
+		return err
+	}
+	p.bStmt = bStmt
+
+	rdb, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", p.path))
+	if err != nil {
+		bStmt.Close()
+		hStmt.Close()
+		db.Close()
+		return err
+	}
+	rdb.SetMaxOpenConns(b.readers)
+	rdb.SetMaxIdleConns(b.readers)
+	if b.partitioning != partitionNone {
+		// There may be many partitions, but only the recent ones are busy
+		rdb.SetMaxIdleConns(1)
+	}
+	p.rdb = rdb
+
+	return nil
+}
+
+func (p *partition) close() {
+	p.bStmt.Close()
+	p.hStmt.Close()
+	p.rdb.Close()
+	p.db.Close()
+}
+
+// id returns the ID of the entry of the partition with rowid.
+func (p *partition) id(rowid int64) int64 {
+	return p.key<<partitionIDShift | rowid
+}
+
+// rowidBound returns the rowid that compares to the rowids of the partition
+// entries like id compares to their IDs.
+func (p *partition) rowidBound(id int64) int64 {
+	switch key := id >> partitionIDShift; {
+	case key < p.key:
+		return 0
+	case key > p.key:
+		return math.MaxInt64
+	}
+	return id & (1<<partitionIDShift - 1)
+}
+
+// overlaps reports if the partition may hold entries from from (included)
+// to to (excluded), where a zero bound is unbounded.
+func (p *partition) overlaps(from, to time.Time) bool {
+	return (p.to.IsZero() || from.IsZero() || from.Before(p.to)) &&
+		(p.from.IsZero() || to.IsZero() || p.from.Before(to))
+}
+
+// overlapping returns the partitions that overlap from and to.
+func overlapping(parts []*partition, from, to time.Time) []*partition {
+	var overlaps []*partition
+	for _, p := range parts {
+		if p.overlaps(from, to) {
+			overlaps = append(overlaps, p)
+		}
+	}
+	return overlaps
+}
+
+// acquirePartitions returns the partitions that overlap from and to, sorted
+// by from, which stay open until they are released.
+func (b *sqliteBackend) acquirePartitions(from, to time.Time) []*partition {
+	b.partsMu.RLock()
+	defer b.partsMu.RUnlock()
+	parts := overlapping(b.parts, from, to)
+	for _, p := range parts {
+		p.refs.Add(1)
+	}
+	return parts
+}
+
+func releasePartitions(parts []*partition) {
+	for _, p := range parts {
+		p.refs.Done()
+	}
+}
+
+// partitionAt returns the partition of the entries at ts, which is created
+// if needed. Only the run loop changes the partitions, so it reads them
+// without locking.
+func (b *sqliteBackend) partitionAt(ts time.Time) (*partition, error) {
+
+	if b.partitioning == partitionNone {
+		return b.parts[0], nil
+	}
+
+	start := b.partitioning.start(ts)
+	if p, ok := b.partsByKey[b.partitioning.key(start)]; ok {
+		return p, nil
+	}
+
+	p := b.newPartition(b.partitioning, start)
+	if removed, ok := b.removing[p.path]; ok {
+		<-removed.removed
+		b.forgetRemovedPartition(removed)
+		if kept, ok := b.partsByKey[p.key]; ok {
+			return kept, nil
+		}
+	}
+	if err := b.openPartition(p); err != nil {
+		return nil, fmt.Errorf("Unable to open partition '%s': %s", p.path, err)
+	}
+	log.Printf("Created partition '%s'", p.path)
+
+	b.addPartitions(p)
+	return p, nil
+}
+
+func (b *sqliteBackend) addPartitions(parts ...*partition) {
+	b.partsMu.Lock()
+	for _, p := range parts {
+		b.parts = append(b.parts, p)
+		b.partsByKey[p.key] = p
+	}
+	sort.Slice(b.parts, func(i, j int) bool {
+		if !b.parts[i].from.Equal(b.parts[j].from) {
+			return b.parts[i].from.Before(b.parts[j].from)
+		}
+		return b.parts[i].key < b.parts[j].key
+	})
+	b.partsMu.Unlock()
+	b.updateSchemaVersion()
+}
+
+// removePartition takes the partition out of the list, then, once the
+// queries using it are done, archives it if needed, closes it and removes its
+// files. A partition that can not be archived is kept, and the run loop is
+// woken up to put it back in the list.
+func (b *sqliteBackend) removePartition(p *partition) {
+
+	b.partsMu.Lock()
+	for i, q := range b.parts {
+		if q == p {
+			b.parts = append(b.parts[:i:i], b.parts[i+1:]...)
+			break
+		}
+	}
+	delete(b.partsByKey, p.key)
+	b.partsMu.Unlock()
+	b.updateSchemaVersion()
+
+	for m := range b.tails {
+		delete(m.lastIDs, p.key)
+	}
+
+	// The partition may be created again in the meantime, by a late entry
+	p.removed = make(chan bool)
+	b.removing[p.path] = p
+	go func() {
+		defer close(p.removed)
+		p.refs.Wait()
+		if b.archiver != nil {
+			archive, err := b.archiver.archivePartition(p)
+			if err != nil {
+				log.Printf("Unable to archive partition '%s', keeping it: %s", p.path, err)
+				p.kept = true
+				defer func() {
+					select {
+					case b.keptQ <- true:
+					default:
+					}
+				}()
+				return
+			}
+			log.Printf("Archived %d entries of partition '%s' to '%s'", archive.Entries, p.path, archive.Name)
+		}
+		p.close()
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Remove(p.path + suffix); err != nil && !os.IsNotExist(err) {
+				log.Printf("Unable to remove partition: %s", err)
+			}
+		}
+		removedPartitions.Inc()
+	}()
+}
+
+// forgetRemovedPartitions forgets the partitions whose files are removed.
+func (b *sqliteBackend) forgetRemovedPartitions() {
+	for _, p := range b.removing {
+		select {
+		case <-p.removed:
+			b.forgetRemovedPartition(p)
+		default:
+		}
+	}
+}
+
+// forgetRemovedPartition forgets a partition done being removed, or puts it
+// back in the list if it was kept, so that its entries are searched again
+// and the next sweep tries to archive it again.
+func (b *sqliteBackend) forgetRemovedPartition(p *partition) {
+	delete(b.removing, p.path)
+	if !p.kept {
+		return
+	}
+	p.kept = false
+	p.removed = nil
+	lastID, err := p.lastRowID()
+	if err != nil {
+		log.Printf("Unable to put back partition '%s': %s", p.path, err)
+		p.close()
+		return
+	}
+	for m := range b.tails {
+		m.lastIDs[p.key] = lastID
+	}
+	b.addPartitions(p)
+}
+
+func (p *partition) lastRowID() (int64, error) {
+	var lastID int64
+	err := p.db.QueryRow("SELECT IFNULL(MAX(rowid), 0) FROM logh").Scan(&lastID)
+	return lastID, err
+}
+
+// updateSchemaVersion sets the schema version the queries can rely on to
+// the oldest one of the partitions.
+func (b *sqliteBackend) updateSchemaVersion() {
+	version := schemaMigrations[len(schemaMigrations)-1].version
+	for _, p := range b.parts {
+		if p.version < version {
+			version = p.version
+		}
+	}
+	atomic.StoreInt32(&b.version, int32(version))
+}
+
+// queryPartition runs the query on the partition, and calls fn for each row.
+func queryPartition(ctx context.Context, p *partition, query string, args []interface{}, fn func(p *partition, rows *sql.Rows) error) error {
+
+	rows, err := p.rdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = fn(p, rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// queryPartitions runs the query on each partition in turn.
+func queryPartitions(ctx context.Context, parts []*partition, query string, args []interface{}, fn func(p *partition, rows *sql.Rows) error) error {
+	for _, p := range parts {
+		if err := queryPartition(ctx, p, query, args, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listRow is an entry, with its position in a list.
+type listRow struct {
+	entry *api.LogEntry
+	pos   *cursor
+}
+
+// fetchRows runs the query built for each partition, and returns the first
+// n rows of all of them, in the given order. Sorted by time, the partitions
+// are visited from the start of the order, up to the first one that can
+// only hold rows past the first n.
+func fetchRows(ctx context.Context, parts []*partition, relevance, asc bool, n int,
+	build func(p *partition) (string, []interface{}), scan func(p *partition, rows *sql.Rows) (*listRow, error)) ([]*listRow, error) {
+
+	if n <= 0 {
+		return nil, nil
+	}
+
+	if !relevance && !asc {
+		parts = append([]*partition{}, parts...)
+		// Unbounded partitions end last
+		sort.SliceStable(parts, func(i, j int) bool {
+			ti, tj := parts[i].to, parts[j].to
+			return !tj.IsZero() && (ti.IsZero() || ti.After(tj))
+		})
+	}
+
+	var rows []*listRow
+	for _, p := range parts {
+		if !relevance && len(rows) >= n && rows[n-1].before(p, asc) {
+			break
+		}
+		query, args := build(p)
+		err := queryPartition(ctx, p, query, args, func(p *partition, r *sql.Rows) error {
+			row, err := scan(p, r)
+			if err == nil {
+				rows = append(rows, row)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].pos.less(rows[j].pos, relevance, asc)
+		})
+		if len(rows) > n {
+			rows = rows[:n]
+		}
+	}
+	return rows, nil
+}
+
+// before reports if the row comes before all the entries of the partition,
+// in time order.
+func (r *listRow) before(p *partition, asc bool) bool {
+	if asc {
+		return !p.from.IsZero() && r.entry.Timestamp.Before(p.from)
+	}
+	return !p.to.IsZero() && !r.entry.Timestamp.Before(p.to)
+}
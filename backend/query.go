@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/utils"
+	"strings"
+	"unicode"
+)
+
+// searchQuery is a parsed search query, like:
+//
+//	host:web-* app:nginx severity:<=err "connection reset" -healthcheck
+//
+// Words and quoted phrases are searched in the message (a word ending with
+// * matches as a prefix), while field:value terms filter on the entry
+// fields. Any term can be negated with a leading -.
+type searchQuery struct {
+	where   []string
+	args    []interface{}
+	match   []string
+	exclude []string
+}
+
+type searchField struct {
+	column string
+	// ordered fields accept the <, <=, >, >= operators, and their value is
+	// parsed with parse, others match a glob pattern if it contains * or ?
+	ordered bool
+	parse   func(string) (int, error)
+}
+
+var searchFields = map[string]*searchField{
+	"host":     {column: "h.host"},
+	"app":      {column: "h.app"},
+	"procid":   {column: "h.procid"},
+	"msgid":    {column: "h.msgid"},
+	"severity": {column: "h.sev", ordered: true, parse: utils.ParseSeverity},
+	"sev":      {column: "h.sev", ordered: true, parse: utils.ParseSeverity},
+	"facility": {column: "h.fac", ordered: true, parse: utils.ParseFacility},
+	"fac":      {column: "h.fac", ordered: true, parse: utils.ParseFacility},
+}
+
+type searchQueryError struct {
+	pos int
+	msg string
+}
+
+func (e *searchQueryError) Error() string {
+	return fmt.Sprintf("invalid query at character %d: %s", e.pos+1, e.msg)
+}
+
+// parseSearchQuery parses q. The message search it builds uses the FTS5
+// syntax when fts5 is set, or else the FTS4 one.
+func parseSearchQuery(q string, fts5 bool) (*searchQuery, error) {
+
+	sq := searchQuery{}
+	r := []rune(q)
+	i := 0
+
+	for {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i == len(r) {
+			break
+		}
+		start := i
+
+		negate := false
+		if r[i] == '-' {
+			negate = true
+			i++
+			if i == len(r) || unicode.IsSpace(r[i]) {
+				return nil, &searchQueryError{start, "nothing to exclude after -"}
+			}
+		}
+
+		// A field name is only known once the colon is found
+		if r[i] != '"' {
+			j := i
+			for j < len(r) && unicode.IsLetter(r[j]) {
+				j++
+			}
+			if j < len(r) && r[j] == ':' {
+				if f, ok := searchFields[strings.ToLower(string(r[i:j]))]; ok {
+					name := string(r[i:j])
+					i = j + 1
+					value, next, err := readSearchValue(r, i)
+					if err != nil {
+						return nil, err
+					}
+					if value == "" {
+						return nil, &searchQueryError{start, fmt.Sprintf("missing value for %s", name)}
+					}
+					if err = sq.addFilter(f, value, negate); err != nil {
+						return nil, &searchQueryError{i, err.Error()}
+					}
+					i = next
+					continue
+				}
+			}
+		}
+
+		quoted := r[i] == '"'
+		value, next, err := readSearchValue(r, i)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+		if value == "" {
+			continue
+		}
+
+		expr := ftsPhrase(value, quoted, fts5)
+		if expr == "" {
+			continue
+		}
+		if negate {
+			sq.exclude = append(sq.exclude, expr)
+		} else {
+			sq.match = append(sq.match, expr)
+		}
+	}
+
+	return &sq, nil
+}
+
+// readSearchValue reads a value starting at i, quoted or up to the next
+// space, and returns it with the position after it.
+func readSearchValue(r []rune, i int) (string, int, error) {
+	if i < len(r) && r[i] == '"' {
+		start := i
+		i++
+		var b strings.Builder
+		for ; i < len(r); i++ {
+			if r[i] == '"' {
+				return b.String(), i + 1, nil
+			}
+			b.WriteRune(r[i])
+		}
+		return "", 0, &searchQueryError{start, "missing closing quote"}
+	}
+	start := i
+	for i < len(r) && !unicode.IsSpace(r[i]) {
+		i++
+	}
+	return string(r[start:i]), i, nil
+}
+
+func (sq *searchQuery) addFilter(f *searchField, value string, negate bool) error {
+
+	var cond string
+	if f.ordered {
+		op := "="
+		for _, o := range []string{"<=", ">=", "<", ">", "="} {
+			if strings.HasPrefix(value, o) {
+				op = o
+				value = value[len(o):]
+				break
+			}
+		}
+		n, err := f.parse(value)
+		if err != nil {
+			return err
+		}
+		cond = fmt.Sprintf("%s %s ?", f.column, op)
+		sq.args = append(sq.args, n)
+	} else if strings.ContainsAny(value, "*?") {
+		cond = fmt.Sprintf("%s GLOB ?", f.column)
+		sq.args = append(sq.args, value)
+	} else {
+		cond = fmt.Sprintf("%s = ?", f.column)
+		sq.args = append(sq.args, value)
+	}
+
+	if negate {
+		cond = "NOT " + cond
+	}
+	sq.where = append(sq.where, cond)
+	return nil
+}
+
+// ftsPhrase quotes s as an FTS phrase, so that it is searched as is. An
+// unquoted word ending with * is searched as a prefix.
+func ftsPhrase(s string, quoted bool, fts5 bool) string {
+	prefix := !quoted && strings.HasSuffix(s, "*")
+	if prefix {
+		s = strings.TrimRight(s, "*")
+		if s == "" {
+			return ""
+		}
+	}
+	s = strings.Replace(s, `"`, `""`, -1)
+	switch {
+	case prefix && fts5:
+		return `"` + s + `" *`
+	case prefix:
+		return `"` + s + `*"`
+	}
+	return `"` + s + `"`
+}
+
+// searchQuery parses the Query of the request, and returns it with the FTS
+// expression the message must match (combined with the raw Message), if any.
+func (b *sqliteBackend) searchQuery(req *api.QueryRequest) (*searchQuery, string, error) {
+	fts5 := b.schemaVersion() >= 2
+	sq, err := parseSearchQuery(req.Query, fts5)
+	if err != nil {
+		return nil, "", err
+	}
+	match := strings.Join(sq.match, " ")
+	switch {
+	case req.Message == "":
+		return sq, match, nil
+	case match == "":
+		return sq, req.Message, nil
+	case fts5:
+		return sq, "(" + req.Message + ") AND " + match, nil
+	}
+	return sq, req.Message + " " + match, nil
+}
+
+// excludeExpr returns the FTS expression the message must not match, if
+// any.
+func (sq *searchQuery) excludeExpr() string {
+	return strings.Join(sq.exclude, " OR ")
+}
@@ -0,0 +1,603 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"github.com/pierredavidbelanger/raftman/utils"
+	"log"
+	"strings"
+	"time"
+)
+
+func retentionDeleted(reason string) *metrics.Counter {
+	return metrics.GetCounter("raftman_backend_retention_deleted_entries_total", "Number of entries deleted by the retention.",
+		"reason", reason)
+}
+
+// retentionRule keeps the entries matching its query (fields only, ie:
+// app:haproxy severity:>=info) for its own retention, instead of the global
+// one.
+type retentionRule struct {
+	query     string
+	where     string
+	args      []interface{}
+	retention utils.Retention
+}
+
+// parseRetentionRules parses rules separated by commas, each one a query
+// and a retention separated by the last =, like:
+//
+//	app:haproxy=1d,app:audit*=52w
+func parseRetentionRules(s string) ([]*retentionRule, error) {
+	var rules []*retentionRule
+	for _, rs := range strings.Split(s, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+		i := strings.LastIndex(rs, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("missing retention in rule '%s'", rs)
+		}
+		query, rt := strings.TrimSpace(rs[:i]), strings.TrimSpace(rs[i+1:])
+		retention, err := utils.ParseRetention(rt)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %s", rs, err)
+		}
+		sq, err := parseSearchQuery(query, true)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %s", rs, err)
+		}
+		if len(sq.match) > 0 || len(sq.exclude) > 0 {
+			return nil, fmt.Errorf("rule '%s': only fields can be matched", rs)
+		}
+		if len(sq.where) == 0 {
+			return nil, fmt.Errorf("rule '%s': missing fields to match", rs)
+		}
+		rules = append(rules, &retentionRule{query, strings.Join(sq.where, " AND "), sq.args, retention})
+	}
+	return rules, nil
+}
+
+type retentionReport struct {
+	reasons []string
+	deleted map[string]int
+	removed int
+}
+
+func (r *retentionReport) add(reason string, n int) {
+	if r.deleted == nil {
+		r.deleted = make(map[string]int)
+	}
+	if _, ok := r.deleted[reason]; !ok {
+		r.reasons = append(r.reasons, reason)
+	}
+	r.deleted[reason] += n
+	retentionDeleted(reason).Add(uint64(n))
+}
+
+func (r *retentionReport) String() string {
+	total := 0
+	parts := make([]string, 0, len(r.reasons))
+	for _, reason := range r.reasons {
+		total += r.deleted[reason]
+		parts = append(parts, fmt.Sprintf("%s: %d", reason, r.deleted[reason]))
+	}
+	s := "Retention deleted no entries"
+	if total > 0 {
+		s = fmt.Sprintf("Retention deleted %d entries (%s)", total, strings.Join(parts, ", "))
+	}
+	if r.removed > 0 {
+		s = fmt.Sprintf("%s and removed %d partitions", s, r.removed)
+	}
+	return s
+}
+
+// retentionMergePages is how many pages of the full text index a merge
+// batch writes at most.
+const retentionMergePages = 256
+
+// retentionMergeRatio is the part of the entries, deleted since the full
+// text index was last merged, that makes it worth merging again, as a merge
+// ends up rewriting most of it.
+const retentionMergeRatio = 10
+
+// retentionVacuumPages is how many free pages an incremental vacuum batch
+// gives back to the file system.
+const retentionVacuumPages = 1024
+
+// retentionSweep is a sweep in progress. The run loop calls its batches
+// between inserts, each one deleting a chunk of at most retentionBatchSize
+// entries in its own transaction, so that a big sweep does not hold back
+// the backend.
+type retentionSweep struct {
+	start     time.Time
+	steps     []*retentionStep
+	sized     bool
+	merge     []*partition
+	vacuum    []*partition
+	vacuuming bool
+	vacuumed  int64
+	archive   *archiveWriter
+	report    retentionReport
+}
+
+// retentionStep deletes the entries of a partition matching where, oldest
+// first, and at most limit of them if limit is positive.
+type retentionStep struct {
+	part   *partition
+	reason string
+	where  string
+	args   []interface{}
+	limit  int64
+}
+
+// handleRetention starts a sweep, that removes the partitions whose entries
+// are all older than the longest retention, deletes the entries older than
+// the retention of the first rule they match, or else older than the global
+// retention, then the oldest partitions and entries until the database fits
+// in maxSize, then gives the free pages back if vacuum is incremental.
+// Deleted entries are only marked as such in the full text index, which is
+// merged once enough of them are to actually free their space. It returns
+// false if there is nothing to do.
+func (b *sqliteBackend) handleRetention(now time.Time) bool {
+
+	if b.sweep != nil {
+		log.Printf("Retention sweep still running, skipping this one")
+		return true
+	}
+
+	b.forgetRemovedPartitions()
+
+	s := retentionSweep{start: now}
+
+	// The entries kept for the longest retention are deleted along with
+	// their partition, once they all are older than it
+	longest := b.longestRetention()
+	if longest != utils.INF {
+		cutoff := now.Add(-time.Duration(longest))
+		for _, p := range append([]*partition{}, b.parts...) {
+			if !p.to.IsZero() && !p.to.After(cutoff) {
+				b.removePartition(p)
+				s.report.removed++
+			}
+		}
+	}
+
+	// Each rule only applies to the entries no previous rule matches
+	var others []string
+	var othersArgs []interface{}
+	for _, rule := range b.rules {
+		if rule.retention != utils.INF {
+			where := append([]string{"h.ts < ?", rule.where}, others...)
+			args := append([]interface{}{now.Add(-time.Duration(rule.retention))}, rule.args...)
+			args = append(args, othersArgs...)
+			s.addSteps(b.parts, rule.retention == longest, &retentionStep{reason: rule.query, where: strings.Join(where, " AND "), args: args})
+		}
+		others = append(others, fmt.Sprintf("NOT (%s)", rule.where))
+		othersArgs = append(othersArgs, rule.args...)
+	}
+
+	if b.retention != utils.INF {
+		where := append([]string{"h.ts < ?"}, others...)
+		args := append([]interface{}{now.Add(-time.Duration(b.retention))}, othersArgs...)
+		s.addSteps(b.parts, b.retention == longest, &retentionStep{reason: "retention", where: strings.Join(where, " AND "), args: args})
+	}
+
+	if len(s.steps) == 0 && b.maxSize == 0 && !b.vacuum {
+		// Keep all the things!
+		if s.report.removed > 0 {
+			log.Printf("%s in %s", &s.report, time.Since(s.start).Truncate(time.Millisecond))
+		}
+		return false
+	}
+
+	b.sweep = &s
+	return true
+}
+
+// longestRetention returns the longest of the retentions.
+func (b *sqliteBackend) longestRetention() utils.Retention {
+	longest := b.retention
+	for _, rule := range b.rules {
+		if longest != utils.INF && (rule.retention == utils.INF || rule.retention > longest) {
+			longest = rule.retention
+		}
+	}
+	return longest
+}
+
+// addSteps adds a copy of the step for each partition that may hold entries
+// older than its cutoff, its first argument, or only for the unbounded ones.
+func (s *retentionSweep) addSteps(parts []*partition, unboundedOnly bool, step *retentionStep) {
+	cutoff := step.args[0].(time.Time)
+	for _, p := range parts {
+		if p.to.IsZero() || (!unboundedOnly && p.from.Before(cutoff)) {
+			partStep := *step
+			partStep.part = p
+			s.steps = append(s.steps, &partStep)
+		}
+	}
+}
+
+// handleRetentionBatch runs the next chunk of the sweep, and returns false
+// once the sweep is done.
+func (b *sqliteBackend) handleRetentionBatch() bool {
+
+	s := b.sweep
+
+	if len(s.steps) == 0 && len(s.merge) > 0 {
+		p := s.merge[0]
+		more, err := p.mergeFullTextIndex()
+		if err != nil {
+			log.Printf("Unable to merge full text index: %s", err)
+		}
+		if !more || err != nil {
+			s.merge = s.merge[1:]
+		}
+		if !more && err == nil {
+			p.unmerged = 0
+		}
+		return true
+	}
+
+	// The size an entry takes is only an estimate, which the next sweep
+	// corrects
+	if len(s.steps) == 0 && b.maxSize > 0 && !s.sized {
+		s.sized = true
+		step, err := b.retentionSizeStep(s)
+		if err != nil {
+			log.Printf("Unable to measure database size: %s", err)
+		}
+		if step != nil {
+			s.steps = append(s.steps, step)
+		}
+	}
+
+	if len(s.steps) > 0 && b.archiver != nil && s.archive == nil {
+		var err error
+		s.archive, err = b.archiver.create("retention-" + s.start.UTC().Format("20060102T150405Z"))
+		if err != nil {
+			log.Printf("Unable to archive, keeping the entries: %s", err)
+			s.steps = nil
+		}
+	}
+
+	if len(s.steps) > 0 {
+		step := s.steps[0]
+		n, done, err := b.deleteEntries(step, s.archive)
+		if err != nil {
+			log.Printf("Unable to delete: %s", err)
+			done = true
+		}
+		s.report.add(step.reason, n)
+		if step.part.version >= 2 {
+			step.part.unmerged += int64(n)
+		}
+		if done {
+			s.steps = s.steps[1:]
+			if len(s.steps) == 0 {
+				s.merge = nil
+				for _, p := range b.parts {
+					if p.fullTextIndexNeedsMerge() {
+						s.merge = append(s.merge, p)
+					}
+				}
+			}
+		}
+		return true
+	}
+
+	if b.vacuum {
+		if !s.vacuuming {
+			s.vacuuming = true
+			s.vacuum = append([]*partition{}, b.parts...)
+		}
+		for len(s.vacuum) > 0 {
+			n, err := s.vacuum[0].incrementalVacuum(retentionVacuumPages)
+			if err != nil {
+				log.Printf("Unable to vacuum: %s", err)
+			} else if n > 0 {
+				s.vacuumed += n
+				return true
+			}
+			s.vacuum = s.vacuum[1:]
+		}
+	}
+
+	if s.archive != nil {
+		if s.archive.archive.Entries == 0 {
+			s.archive.abort()
+		} else if archive, err := s.archive.close(); err != nil {
+			log.Printf("Unable to archive: %s", err)
+		} else {
+			log.Printf("Archived %d entries to '%s'", archive.Entries, archive.Name)
+		}
+	}
+
+	log.Printf("%s in %s, %d pages vacuumed", &s.report, time.Since(s.start).Truncate(time.Millisecond), s.vacuumed)
+	b.sweep = nil
+	return false
+}
+
+// retentionSizeStep removes the oldest partitions, but the newest one, then
+// returns a step that deletes enough of the oldest entries of the oldest
+// partition left, for the database to fit in maxSize, or nil if it already
+// does.
+func (b *sqliteBackend) retentionSizeStep(s *retentionSweep) (*retentionStep, error) {
+	if len(b.parts) == 0 {
+		return nil, nil
+	}
+	sizes := make([]int64, len(b.parts))
+	var used int64
+	for i, p := range b.parts {
+		size, err := p.usedSize()
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+		used += size
+	}
+	for len(b.parts) > 1 && used > int64(b.maxSize) {
+		used -= sizes[0]
+		sizes = sizes[1:]
+		b.removePartition(b.parts[0])
+		s.report.removed++
+	}
+	if used <= int64(b.maxSize) {
+		return nil, nil
+	}
+	p := b.parts[0]
+	var count int64
+	if err := p.db.QueryRow("SELECT COUNT(*) FROM logh").Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	n := (used-int64(b.maxSize))/(sizes[0]/count) + 1
+	return &retentionStep{part: p, reason: "maxSize", where: "1", limit: n}, nil
+}
+
+// usedSize returns the size of the pages of the partition that are in use.
+func (p *partition) usedSize() (int64, error) {
+	var pageCount, freelistCount, pageSize int64
+	for _, pragma := range []struct {
+		name string
+		v    *int64
+	}{
+		{"page_count", &pageCount},
+		{"freelist_count", &freelistCount},
+		{"page_size", &pageSize},
+	} {
+		if err := p.db.QueryRow("PRAGMA " + pragma.name).Scan(pragma.v); err != nil {
+			return 0, err
+		}
+	}
+	return (pageCount - freelistCount) * pageSize, nil
+}
+
+// deleteEntries deletes the next chunk of the oldest entries of the step, in
+// a transaction, once written to the archive, if any, and reports if the
+// step is done.
+func (b *sqliteBackend) deleteEntries(step *retentionStep, archive *archiveWriter) (int, bool, error) {
+
+	batchSize := int64(b.chunkSize)
+	if step.limit > 0 && step.limit < batchSize {
+		batchSize = step.limit
+	}
+
+	tx, err := step.part.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+
+	n, err := deleteEntriesBatch(tx, step, batchSize, archive)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Printf("Unable to rollback: %s", rollbackErr)
+		}
+		return 0, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
+	}
+
+	done := n < batchSize
+	if step.limit > 0 {
+		step.limit -= n
+		done = done || step.limit <= 0
+	}
+	return int(n), done, nil
+}
+
+func deleteEntriesBatch(tx *sql.Tx, step *retentionStep, batchSize int64, archive *archiveWriter) (int64, error) {
+
+	var err error
+
+	// The chunk is kept aside, as the oldest entries are not always the
+	// first inserted ones
+	for _, q := range []string{
+		"CREATE TEMP TABLE IF NOT EXISTS retention_chunk (rowid INTEGER PRIMARY KEY)",
+		"DELETE FROM temp.retention_chunk",
+	} {
+		if _, err = tx.Exec(q); err != nil {
+			return 0, err
+		}
+	}
+
+	args := append(append([]interface{}{}, step.args...), batchSize)
+	res, err := tx.Exec(fmt.Sprintf("INSERT INTO temp.retention_chunk (rowid) SELECT h.rowid FROM logh AS h WHERE %s ORDER BY h.ts LIMIT ?", step.where), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	// Most often they are though, and then the chunk is a range of rowids,
+	// which is quicker to delete, from the full text index in particular
+	var lo, hi, count int64
+	err = tx.QueryRow("SELECT MIN(rowid), MAX(rowid) FROM temp.retention_chunk").Scan(&lo, &hi)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM logh WHERE rowid BETWEEN ? AND ?", lo, hi).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	// The archived entries are on disk before they are deleted
+	if archive != nil {
+		rows, err := tx.Query("SELECT " + sqlArchiveColumns + " FROM temp.retention_chunk AS c JOIN logh AS h ON h.rowid = c.rowid JOIN logb AS b ON b.rowid = h.rowid ORDER BY h.ts, h.rowid")
+		if err != nil {
+			return 0, err
+		}
+		err = writeArchiveRows(archive, rows)
+		rows.Close()
+		if err == nil {
+			err = archive.sync()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Unable to archive: %s", err)
+		}
+	}
+
+	const rowids = "SELECT rowid FROM temp.retention_chunk"
+	for _, table := range []string{"logb", "logh"} {
+		if count == n {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid BETWEEN ? AND ?", table), lo, hi)
+		} else {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid IN (%s)", table, rowids))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if m := step.part.migration; m != nil && m.delete != nil {
+		err = m.delete(tx, rowids)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// fullTextIndexNeedsMerge reports if enough entries were deleted since the
+// full text index of the partition was last merged.
+func (p *partition) fullTextIndexNeedsMerge() bool {
+	if p.unmerged == 0 {
+		return false
+	}
+	var span int64
+	err := p.db.QueryRow("SELECT IFNULL(MAX(rowid) - MIN(rowid) + 1, 0) FROM logh").Scan(&span)
+	if err != nil {
+		log.Printf("Unable to count entries: %s", err)
+		return false
+	}
+	return p.unmerged*retentionMergeRatio >= span
+}
+
+// mergeFullTextIndex merges the segments of the full text index, at most
+// retentionMergePages pages at a time, and reports if there is more to merge.
+func (p *partition) mergeFullTextIndex() (bool, error) {
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// The merge does nothing but its own insert once there is no more to
+	// merge
+	var before, after int64
+	err = tx.QueryRow("SELECT total_changes()").Scan(&before)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO logb (logb, rank) VALUES ('merge', ?)", -retentionMergePages)
+	}
+	if err == nil {
+		err = tx.QueryRow("SELECT total_changes()").Scan(&after)
+	}
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			log.Printf("Unable to rollback: %s", rollbackErr)
+		}
+		return false, err
+	}
+
+	return after-before > 1, tx.Commit()
+}
+
+// enableIncrementalVacuum switches the database to incremental vacuum. Only
+// an empty database can be switched in place, others have to be vacuumed
+// once.
+func enableIncrementalVacuum(db *sql.DB) error {
+
+	ctx := context.Background()
+
+	// The setting only lasts on this connection until the vacuum
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	err = conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode)
+	if err != nil || mode == 2 {
+		return err
+	}
+
+	var tables int
+	err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables > 0 {
+		log.Printf("Enabling incremental vacuum, the database is vacuumed once, this may take a while")
+	}
+
+	for _, q := range []string{"PRAGMA auto_vacuum = INCREMENTAL", "VACUUM"} {
+		if _, err = conn.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// incrementalVacuum gives at most pages free pages back to the file system,
+// and returns how many it gave.
+func (p *partition) incrementalVacuum(pages int) (int64, error) {
+
+	var before, after int64
+	err := p.db.QueryRow("PRAGMA freelist_count").Scan(&before)
+	if err != nil || before == 0 {
+		return 0, err
+	}
+
+	// Each step of the pragma frees one page
+	rows, err := p.db.Query(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	err = p.db.QueryRow("PRAGMA freelist_count").Scan(&after)
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
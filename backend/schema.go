@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// schemaMigration upgrades the database schema to its version, which is
+// recorded in the database user_version once done.
+//
+// up runs in a transaction when the backend starts, so it must be quick. A
+// migration that has to go through all the entries does it in batch, which
+// is called repeatedly in a transaction between inserts, until it reports it
+// is done. Until then, the entries inserted and deleted also go through
+// insert and delete (given a query of the rowids deleted).
+type schemaMigration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+	batch   func(tx *sql.Tx) (bool, error)
+	insert  func(tx *sql.Tx, rowid int64, msg string) error
+	delete  func(tx *sql.Tx, rowids string) error
+}
+
+const schemaMigrationBatchSize = 1024
+
+var schemaMigrations = []*schemaMigration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up:      migrateInitialSchema,
+	},
+	{
+		version: 2,
+		name:    "full text index in FTS5",
+		up:      migrateFTS5Up,
+		batch:   migrateFTS5Batch,
+		insert: func(tx *sql.Tx, rowid int64, msg string) error {
+			_, err := tx.Exec("INSERT INTO logb_fts5 (rowid, msg) VALUES (?, ?)", rowid, msg)
+			return err
+		},
+		delete: func(tx *sql.Tx, rowids string) error {
+			_, err := tx.Exec(fmt.Sprintf("DELETE FROM logb_fts5 WHERE rowid IN (%s)", rowids))
+			return err
+		},
+	},
+}
+
+func readSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func setSchemaVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// checkFTS5 checks that SQLite was built with FTS5, which the schema needs,
+// so that raftman fails on start rather than on the first schema change.
+func checkFTS5() error {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var used bool
+	if err = db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used); err != nil {
+		return err
+	}
+	if !used {
+		return fmt.Errorf("raftman was built without FTS5, rebuild it with -tags fts5")
+	}
+	return nil
+}
+
+func schemaMigrationError(m *schemaMigration, err error) error {
+	if strings.Contains(err.Error(), "no such module: fts5") {
+		err = fmt.Errorf("%s (raftman must be built with -tags fts5)", err)
+	}
+	return fmt.Errorf("Unable to migrate database schema to version %d (%s): %s", m.version, m.name, err)
+}
+
+// migrateSchema runs the migrations newer than the partition schema, up to
+// the first one that has to continue in batch, which is then left in
+// p.migration.
+func (p *partition) migrateSchema() error {
+
+	version, err := readSchemaVersion(p.db)
+	if err != nil {
+		return err
+	}
+	p.version = version
+	latest := schemaMigrations[len(schemaMigrations)-1].version
+	if version > latest {
+		return fmt.Errorf("Unsupported database schema version %d in '%s', at most %d is supported", version, p.path, latest)
+	}
+
+	for _, m := range schemaMigrations {
+		if m.version <= version {
+			continue
+		}
+
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err = m.up(tx); err != nil {
+			tx.Rollback()
+			return schemaMigrationError(m, err)
+		}
+		if m.batch == nil {
+			if err = setSchemaVersion(tx, m.version); err != nil {
+				tx.Rollback()
+				return schemaMigrationError(m, err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return schemaMigrationError(m, err)
+		}
+
+		if m.batch != nil {
+			log.Printf("Migrating database schema of '%s' to version %d (%s) in the background", p.path, m.version, m.name)
+			p.migration = m
+			return nil
+		}
+		log.Printf("Migrated database schema of '%s' to version %d (%s)", p.path, m.version, m.name)
+		version = m.version
+		p.version = version
+	}
+
+	p.migration = nil
+	return nil
+}
+
+// schemaVersion returns the version of the schema the queries can rely on.
+func (b *sqliteBackend) schemaVersion() int {
+	return int(atomic.LoadInt32(&b.version))
+}
+
+// handleSchemaMigration runs one batch of the running migration of the
+// first partition that has one, and returns false once there is nothing
+// left to run.
+func (b *sqliteBackend) handleSchemaMigration() bool {
+	for _, p := range b.parts {
+		if p.migration == nil {
+			continue
+		}
+		if p.handleSchemaMigration() {
+			return true
+		}
+		b.updateSchemaVersion()
+	}
+	return false
+}
+
+// handleSchemaMigration runs one batch of the running migration, and
+// returns false once there is nothing left to run.
+func (p *partition) handleSchemaMigration() bool {
+
+	m := p.migration
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		log.Printf("Unable to begin transaction: %s", err)
+		p.migration = nil
+		return false
+	}
+
+	done, err := m.batch(tx)
+	if err == nil && done {
+		err = setSchemaVersion(tx, m.version)
+	}
+	if err != nil {
+		log.Printf("%s", schemaMigrationError(m, err))
+		err = tx.Rollback()
+		if err != nil {
+			log.Printf("Unable to rollback: %s", err)
+		}
+		p.migration = nil
+		return false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("Unable to commit transaction: %s", err)
+		p.migration = nil
+		return false
+	}
+
+	if !done {
+		return true
+	}
+
+	log.Printf("Migrated database schema of '%s' to version %d (%s)", p.path, m.version, m.name)
+	p.version = m.version
+	if err = p.migrateSchema(); err != nil {
+		log.Printf("%s", err)
+		p.migration = nil
+	}
+	return p.migration != nil
+}
+
+func migrateInitialSchema(tx *sql.Tx) error {
+
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS logh (ts DATETIME, host VARCHAR(255), app VARCHAR(255))")
+	if err != nil {
+		return err
+	}
+
+	// Entries stored before those columns existed default to the RFC3164
+	// priority 13 (user.notice), which is what a message without PRI gets
+	for _, c := range []struct{ name, decl string }{
+		{"prio", "INTEGER NOT NULL DEFAULT 13"},
+		{"fac", "INTEGER NOT NULL DEFAULT 1"},
+		{"sev", "INTEGER NOT NULL DEFAULT 5"},
+		{"procid", "VARCHAR(128) NOT NULL DEFAULT ''"},
+		{"msgid", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"sd", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		err = addColumnIfMissing(tx, "logh", c.name, c.decl)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS logh_idx ON logh (ts, host, app)")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS logb USING FTS4(msg, tokenize=unicode61)")
+	return err
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, decl string) error {
+
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// migrateFTS5Up creates the FTS5 table next to the FTS4 one, and remembers
+// up to which entry it has to be filled from the FTS4 table. The entries
+// inserted after that go in both tables.
+func migrateFTS5Up(tx *sql.Tx) error {
+
+	_, err := tx.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS logb_fts5 USING fts5(msg, tokenize=unicode61, prefix='2 3')")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS logb_fts5_copy (upto INTEGER NOT NULL, pos INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO logb_fts5_copy (upto, pos) SELECT (SELECT IFNULL(MAX(rowid), 0) FROM logb), 0 WHERE NOT EXISTS (SELECT 1 FROM logb_fts5_copy)")
+	return err
+}
+
+// migrateFTS5Batch copies the next entries from the FTS4 table, then, once
+// all are copied, replaces the FTS4 table with the FTS5 one.
+func migrateFTS5Batch(tx *sql.Tx) (bool, error) {
+
+	var upto, pos int64
+	err := tx.QueryRow("SELECT upto, pos FROM logb_fts5_copy").Scan(&upto, &pos)
+	if err != nil {
+		return false, err
+	}
+
+	var next sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(rowid) FROM (SELECT rowid FROM logb WHERE rowid > ? AND rowid <= ? ORDER BY rowid LIMIT ?)",
+		pos, upto, schemaMigrationBatchSize).Scan(&next)
+	if err != nil {
+		return false, err
+	}
+
+	if next.Valid {
+		_, err = tx.Exec("INSERT INTO logb_fts5 (rowid, msg) SELECT rowid, msg FROM logb WHERE rowid > ? AND rowid <= ?", pos, next.Int64)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec("UPDATE logb_fts5_copy SET pos = ?", next.Int64)
+		return false, err
+	}
+
+	for _, q := range []string{
+		"DROP TABLE logb",
+		"ALTER TABLE logb_fts5 RENAME TO logb",
+		"DROP TABLE logb_fts5_copy",
+	} {
+		if _, err = tx.Exec(q); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,491 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errSpoolClosed = errors.New("spool closed")
+
+const spoolMaxRecordSize = 16 << 20
+
+// spoolRetryDelay is how long to wait before reading the spool again after
+// an error.
+const spoolRetryDelay = 1 * time.Second
+
+type spoolPos struct {
+	seq int64
+	off int64
+}
+
+type spoolSeg struct {
+	seq  int64
+	size int64
+}
+
+// spool is an on-disk queue of entries in front of the insert queue, so
+// that inserting never waits on the backend (unless the spool is full), and
+// that queued entries survive a restart or a crash.
+//
+// Entries are appended to segment files as records (length, CRC32, JSON),
+// and read back in order to feed the insert queue. Once the backend reports
+// how many of them it has consumed, the position of the last one is saved,
+// and the segments before it are deleted. On open, the reading restarts from
+// that saved position, so an entry is delivered at least once.
+//
+// The segments are synced to disk every syncInterval, or after each entry if
+// it is zero: on a host crash or a power loss, the entries written since the
+// last sync may be lost.
+type spool struct {
+	dir          string
+	maxSize      int64
+	segSize      int64
+	syncInterval time.Duration
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	closed    bool
+	segs      []*spoolSeg
+	size      int64
+	w         *os.File
+	r         *os.File
+	rSeq      int64
+	rPos      spoolPos
+	pending   []spoolPos
+	committed spoolPos
+	dirty     bool
+
+	stopQ     chan bool
+	doneQ     chan bool
+	syncDoneQ chan bool
+}
+
+func openSpool(dir string, maxSize int64, syncInterval time.Duration) (*spool, error) {
+
+	s := spool{dir: dir, maxSize: maxSize, segSize: maxSize / 4, syncInterval: syncInterval,
+		stopQ: make(chan bool), doneQ: make(chan bool), syncDoneQ: make(chan bool)}
+	s.cond = sync.NewCond(&s.mu)
+	if s.segSize > 64<<20 {
+		s.segSize = 64 << 20
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		s.segs = append(s.segs, &spoolSeg{seq, fi.Size()})
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "committed")); err == nil {
+		if _, err = fmt.Sscanf(string(data), "%d %d", &s.committed.seq, &s.committed.off); err != nil {
+			return nil, fmt.Errorf("Invalid spool committed position: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(s.segs) == 0 {
+		s.segs = append(s.segs, &spoolSeg{s.committed.seq + 1, 0})
+	}
+
+	// Only the last segment can end with a partially written record
+	last := s.segs[len(s.segs)-1]
+	w, err := os.OpenFile(s.segPath(last.seq), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := validSegmentSize(w)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if valid != last.size {
+		log.Printf("Truncate spool segment %d from %d to %d bytes", last.seq, last.size, valid)
+		if err = w.Truncate(valid); err != nil {
+			w.Close()
+			return nil, err
+		}
+		last.size = valid
+	}
+	if _, err = w.Seek(valid, io.SeekStart); err != nil {
+		w.Close()
+		return nil, err
+	}
+	s.w = w
+
+	s.deleteSegmentsBefore(s.committed.seq)
+	if s.committed.seq < s.segs[0].seq || s.committed.seq > last.seq {
+		s.committed = spoolPos{s.segs[0].seq, 0}
+	}
+	s.rPos = s.committed
+
+	for _, seg := range s.segs {
+		s.size += seg.size
+	}
+
+	if s.syncInterval > 0 {
+		go s.syncLoop()
+	} else {
+		close(s.syncDoneQ)
+	}
+
+	return &s, nil
+}
+
+func (s *spool) segPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.seg", seq))
+}
+
+func readSpoolRecord(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n > spoolMaxRecordSize {
+		return nil, fmt.Errorf("spool record too large (%d bytes)", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("spool record checksum mismatch")
+	}
+	return data, nil
+}
+
+// validSegmentSize returns the size of the leading valid records of f.
+func validSegmentSize(f *os.File) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		data, err := readSpoolRecord(r)
+		if err != nil {
+			return valid, nil
+		}
+		valid += int64(8 + len(data))
+	}
+}
+
+func (s *spool) deleteSegmentsBefore(seq int64) {
+	for len(s.segs) > 1 && s.segs[0].seq < seq {
+		if err := os.Remove(s.segPath(s.segs[0].seq)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to delete spool segment %d: %s", s.segs[0].seq, err)
+			return
+		}
+		s.size -= s.segs[0].size
+		s.segs = s.segs[1:]
+	}
+}
+
+func (s *spool) segment(seq int64) *spoolSeg {
+	for _, seg := range s.segs {
+		if seg.seq == seq {
+			return seg
+		}
+	}
+	return nil
+}
+
+// write appends the entry to the spool, waiting for room if it is full.
+func (s *spool) write(e *api.LogEntry) error {
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(data))
+	copy(rec[8:], data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && s.size > 0 && s.size+int64(len(rec)) > s.maxSize {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return errSpoolClosed
+	}
+
+	last := s.segs[len(s.segs)-1]
+	if last.size >= s.segSize {
+		if err = s.w.Sync(); err != nil {
+			return err
+		}
+		w, err := os.OpenFile(s.segPath(last.seq+1), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if err = syncDir(s.dir); err != nil {
+			w.Close()
+			return err
+		}
+		s.w.Close()
+		s.w = w
+		s.dirty = false
+		last = &spoolSeg{last.seq + 1, 0}
+		s.segs = append(s.segs, last)
+	}
+
+	n, err := s.w.Write(rec)
+	if err != nil {
+		// Do not leave a partial record behind
+		s.w.Truncate(last.size)
+		s.w.Seek(last.size, io.SeekStart)
+		return err
+	}
+	last.size += int64(n)
+	s.size += int64(n)
+	s.cond.Broadcast()
+
+	if s.syncInterval == 0 {
+		return s.w.Sync()
+	}
+	s.dirty = true
+
+	return nil
+}
+
+// syncLoop syncs the last segment every syncInterval, if it was written to,
+// until the spool is closed.
+func (s *spool) syncLoop() {
+	defer close(s.syncDoneQ)
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty {
+				if err := s.w.Sync(); err != nil {
+					log.Printf("Unable to sync spool: %s", err)
+				} else {
+					s.dirty = false
+				}
+			}
+			s.mu.Unlock()
+		case <-s.stopQ:
+			return
+		}
+	}
+}
+
+// syncDir syncs the directory dir, so that the files created in or renamed
+// to it survive a host crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileSync writes data to the file path, and syncs it.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// next waits for the next record to read, and returns it with the position
+// after it.
+func (s *spool) next() ([]byte, spoolPos, error) {
+
+	s.mu.Lock()
+	for {
+		if s.closed {
+			s.mu.Unlock()
+			return nil, spoolPos{}, errSpoolClosed
+		}
+		seg := s.segment(s.rPos.seq)
+		if seg != nil && s.rPos.off < seg.size {
+			break
+		}
+		if s.rPos.seq < s.segs[len(s.segs)-1].seq {
+			s.rPos = spoolPos{s.rPos.seq + 1, 0}
+			continue
+		}
+		s.cond.Wait()
+	}
+	pos := s.rPos
+	s.mu.Unlock()
+
+	if s.r == nil || s.rSeq != pos.seq {
+		if s.r != nil {
+			s.r.Close()
+			s.r = nil
+		}
+		r, err := os.Open(s.segPath(pos.seq))
+		if err != nil {
+			return nil, pos, err
+		}
+		s.r = r
+		s.rSeq = pos.seq
+	}
+
+	if _, err := s.r.Seek(pos.off, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+	data, err := readSpoolRecord(s.r)
+
+	s.mu.Lock()
+	if err != nil {
+		// Skip the rest of this corrupted segment
+		s.rPos.off = s.segment(pos.seq).size
+	} else {
+		s.rPos.off += int64(8 + len(data))
+	}
+	end := s.rPos
+	s.mu.Unlock()
+
+	return data, end, err
+}
+
+// run feeds the entries of the spool to out, until the spool is closed.
+func (s *spool) run(out chan<- *api.LogEntry) {
+	defer close(s.doneQ)
+	for {
+		data, end, err := s.next()
+		if err == errSpoolClosed {
+			return
+		}
+		if err != nil {
+			// Do not spin when the segment can not be read at all
+			log.Printf("Unable to read spool: %s", err)
+			select {
+			case <-time.After(spoolRetryDelay):
+			case <-s.stopQ:
+				return
+			}
+			continue
+		}
+		e := api.LogEntry{}
+		if err = json.Unmarshal(data, &e); err != nil {
+			log.Printf("Unable to read spool: %s", err)
+			continue
+		}
+		s.mu.Lock()
+		s.pending = append(s.pending, end)
+		s.mu.Unlock()
+		select {
+		case out <- &e:
+		case <-s.stopQ:
+			s.mu.Lock()
+			s.pending = s.pending[:len(s.pending)-1]
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ack marks the n oldest entries fed by run as consumed.
+func (s *spool) ack(n int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(s.pending) {
+		n = len(s.pending)
+	}
+	if n == 0 {
+		return
+	}
+	s.committed = s.pending[n-1]
+	s.pending = s.pending[n:]
+
+	tmp := filepath.Join(s.dir, "committed.tmp")
+	data := []byte(fmt.Sprintf("%d %d\n", s.committed.seq, s.committed.off))
+	if err := writeFileSync(tmp, data); err != nil {
+		log.Printf("Unable to save spool position: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "committed")); err != nil {
+		log.Printf("Unable to save spool position: %s", err)
+		return
+	}
+	if err := syncDir(s.dir); err != nil {
+		log.Printf("Unable to save spool position: %s", err)
+		return
+	}
+
+	s.deleteSegmentsBefore(s.committed.seq)
+	s.cond.Broadcast()
+}
+
+// len returns the size of the spool, in bytes.
+func (s *spool) len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// close stops feeding entries and rejects new ones. The entries not yet
+// consumed stay in the spool for the next open.
+func (s *spool) close() error {
+
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	close(s.stopQ)
+	<-s.doneQ
+	<-s.syncDoneQ
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	err := s.w.Sync()
+	if closeErr := s.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
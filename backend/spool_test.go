@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T, dir string, maxSize int64) (*spool, chan *api.LogEntry) {
+	t.Helper()
+	s, err := openSpool(dir, maxSize, 0)
+	if err != nil {
+		t.Fatalf("Unable to open spool: %s", err)
+	}
+	out := make(chan *api.LogEntry, 100)
+	go s.run(out)
+	return s, out
+}
+
+func closeTestSpool(t *testing.T, s *spool) {
+	t.Helper()
+	if err := s.close(); err != nil {
+		t.Fatalf("Unable to close spool: %s", err)
+	}
+}
+
+func writeTestEntries(t *testing.T, s *spool, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.write(&api.LogEntry{Hostname: "host", Application: "app", Message: fmt.Sprintf("msg-%d", i)}); err != nil {
+			t.Fatalf("Unable to write entry %d: %s", i, err)
+		}
+	}
+}
+
+// readTestEntries checks that the next entries fed by the spool are from to
+// to, and that no other follows.
+func readTestEntries(t *testing.T, out chan *api.LogEntry, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		select {
+		case e := <-out:
+			if want := fmt.Sprintf("msg-%d", i); e.Message != want {
+				t.Fatalf("Read entry '%s', want '%s'", e.Message, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for entry %d", i)
+		}
+	}
+	select {
+	case e := <-out:
+		t.Fatalf("Read unexpected entry '%s'", e.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestSpoolReopenAfterTruncatedRecord(t *testing.T) {
+
+	badCRC := make([]byte, 8+4)
+	binary.BigEndian.PutUint32(badCRC[0:4], 4)
+	binary.BigEndian.PutUint32(badCRC[4:8], 1)
+	copy(badCRC[8:], "junk")
+
+	partial := make([]byte, 8+10)
+	binary.BigEndian.PutUint32(partial[0:4], 100)
+
+	for name, tail := range map[string][]byte{"partial": partial, "checksum": badCRC, "header": {0, 0}} {
+		t.Run(name, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "spool-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, _ := openTestSpool(t, dir, 1<<20)
+			writeTestEntries(t, s, 0, 3)
+			size := s.len()
+			closeTestSpool(t, s)
+
+			segs := testSegments(t, dir)
+			if len(segs) != 1 {
+				t.Fatalf("Found %d segments, want 1", len(segs))
+			}
+			f, err := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+
+			s, out := openTestSpool(t, dir, 1<<20)
+			defer closeTestSpool(t, s)
+			if s.len() != size {
+				t.Fatalf("Spool size is %d, want %d", s.len(), size)
+			}
+			fi, err := os.Stat(segs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != size {
+				t.Fatalf("Segment size is %d, want %d", fi.Size(), size)
+			}
+			readTestEntries(t, out, 0, 3)
+
+			// New entries are appended right after the last valid record
+			writeTestEntries(t, s, 3, 5)
+			readTestEntries(t, out, 3, 5)
+		})
+	}
+}
+
+func TestSpoolReplayFromCommitted(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, out := openTestSpool(t, dir, 1<<20)
+	writeTestEntries(t, s, 0, 5)
+	readTestEntries(t, out, 0, 5)
+	s.ack(2)
+	closeTestSpool(t, s)
+
+	s, out = openTestSpool(t, dir, 1<<20)
+	readTestEntries(t, out, 2, 5)
+	s.ack(3)
+	closeTestSpool(t, s)
+
+	s, out = openTestSpool(t, dir, 1<<20)
+	defer closeTestSpool(t, s)
+	readTestEntries(t, out, 0, 0)
+}
+
+func TestSpoolSegmentRolloverAndDeletion(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments of 1KB hold a few entries each
+	const maxSize = 4 << 10
+
+	s, out := openTestSpool(t, dir, maxSize)
+	writeTestEntries(t, s, 0, 24)
+	readTestEntries(t, out, 0, 24)
+	before := len(testSegments(t, dir))
+	if before < 3 {
+		t.Fatalf("Found %d segments, want at least 3", before)
+	}
+
+	// Acking the first half deletes the segments it fully covers
+	s.ack(12)
+	after := len(testSegments(t, dir))
+	if after >= before {
+		t.Fatalf("Found %d segments after ack, want less than %d", after, before)
+	}
+	closeTestSpool(t, s)
+
+	s, out = openTestSpool(t, dir, maxSize)
+	readTestEntries(t, out, 12, 24)
+	s.ack(12)
+	if n := len(testSegments(t, dir)); n != 1 {
+		t.Fatalf("Found %d segments after acking all, want 1", n)
+	}
+	closeTestSpool(t, s)
+
+	s, out = openTestSpool(t, dir, maxSize)
+	defer closeTestSpool(t, s)
+	readTestEntries(t, out, 0, 0)
+	writeTestEntries(t, s, 24, 26)
+	readTestEntries(t, out, 24, 26)
+}
+
+func TestSpoolSyncInterval(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1<<20, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unable to open spool: %s", err)
+	}
+	out := make(chan *api.LogEntry, 100)
+	go s.run(out)
+	writeTestEntries(t, s, 0, 3)
+	readTestEntries(t, out, 0, 3)
+	time.Sleep(50 * time.Millisecond)
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+	if dirty {
+		t.Fatalf("Spool not synced after its sync interval")
+	}
+	closeTestSpool(t, s)
+}
@@ -2,34 +2,80 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"github.com/pierredavidbelanger/raftman/spi"
 	"github.com/pierredavidbelanger/raftman/utils"
 	"log"
 	"math"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	insertedEntries = metrics.GetCounter("raftman_backend_inserted_entries_total", "Number of entries inserted.")
+	commits         = metrics.GetCounter("raftman_backend_commits_total", "Number of insert batches committed.")
+	rollbacks       = metrics.GetCounter("raftman_backend_rollbacks_total", "Number of insert batches rolled back.")
+)
+
+func observeQuery(query string, start time.Time) {
+	metrics.GetHistogram("raftman_backend_query_duration_seconds", "Time spent running queries.",
+		metrics.DefaultBuckets, "query", query).Observe(time.Since(start).Seconds())
+}
+
 type sqliteBackend struct {
 	asyncBackend
 	batchSize  int
 	retention  utils.Retention
+	chunkSize  int
+	rules      []*retentionRule
+	maxSize    utils.Size
+	vacuum     bool
+	sweep      *retentionSweep
+	readers    int
 	dbFilePath string
-	db         *sql.DB
-	hStmt      *sql.Stmt
-	bStmt      *sql.Stmt
+	spoolDir   string
+	spoolSize  utils.Size
+	spoolSync  time.Duration
+	spool      *spool
+	archiveDir string
+	archiver   *archiver
+	backupDir  string
+	tails      map[*tailM]bool
+	version    int32
+	readStopQ  chan bool
+	readWG     sync.WaitGroup
+
+	partitioning partitioning
+	partsMu      sync.RWMutex
+	parts        []*partition
+	partsByKey   map[int64]*partition
+	removing     map[string]*partition
+	keptQ        chan bool
+
+	reconfigureQ chan *sqliteBackend
 }
 
 func newSQLiteBackend(backendURL *url.URL) (*sqliteBackend, error) {
 
-	b := sqliteBackend{}
-	err := initAsyncBackend(backendURL, &b.asyncBackend)
+	err := utils.CheckQueryParams(backendURL, append(asyncBackendParams, "batchSize", "retention", "retentionRules", "retentionBatchSize", "maxSize", "vacuum", "partition", "archive", "backup", "readers", "spool", "spoolMaxSize", "spoolSync")...)
+	if err != nil {
+		return nil, err
+	}
+
+	b := sqliteBackend{tails: make(map[*tailM]bool), readStopQ: make(chan bool), reconfigureQ: make(chan *sqliteBackend, 1),
+		partsByKey: make(map[int64]*partition), removing: make(map[string]*partition), keptQ: make(chan bool, 1)}
+	err = initAsyncBackend(backendURL, &b.asyncBackend)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +92,73 @@ func newSQLiteBackend(backendURL *url.URL) (*sqliteBackend, error) {
 	}
 	b.retention = retention
 
+	rules, err := parseRetentionRules(backendURL.Query().Get("retentionRules"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid retentionRules: %s", err)
+	}
+	b.rules = rules
+
+	maxSize, err := utils.GetSizeQueryParam(backendURL, "maxSize", 0)
+	if err != nil {
+		return nil, err
+	}
+	b.maxSize = maxSize
+
+	chunkSize, err := utils.GetIntQueryParam(backendURL, "retentionBatchSize", 1024)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("Invalid retentionBatchSize '%d', must be at least 1", chunkSize)
+	}
+	b.chunkSize = chunkSize
+
+	switch vacuum := backendURL.Query().Get("vacuum"); strings.ToLower(vacuum) {
+	case "", "none":
+	case "incremental":
+		b.vacuum = true
+	default:
+		return nil, fmt.Errorf("Invalid vacuum '%s', must be none or incremental", vacuum)
+	}
+
+	partitioning, err := getPartitioningQueryParam(backendURL, "partition", partitionNone)
+	if err != nil {
+		return nil, err
+	}
+	b.partitioning = partitioning
+
+	readers, err := utils.GetIntQueryParam(backendURL, "readers", 4)
+	if err != nil {
+		return nil, err
+	}
+	if readers < 1 {
+		return nil, fmt.Errorf("Invalid readers '%d', must be at least 1", readers)
+	}
+	b.readers = readers
+
+	b.archiveDir = backendURL.Query().Get("archive")
+	b.backupDir = backendURL.Query().Get("backup")
+
+	b.spoolDir = backendURL.Query().Get("spool")
+	if b.spoolDir != "" && b.overflow.policy != overflowBlock {
+		return nil, fmt.Errorf("Invalid overflow '%s', must be block when a spool is used", b.overflow.policy)
+	}
+
+	spoolSize, err := utils.GetSizeQueryParam(backendURL, "spoolMaxSize", 1*utils.GB)
+	if err != nil {
+		return nil, err
+	}
+	b.spoolSize = spoolSize
+
+	spoolSync, err := utils.GetDurationQueryParam(backendURL, "spoolSync", 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if spoolSync < 0 {
+		return nil, fmt.Errorf("Invalid spoolSync '%s', must not be negative", spoolSync)
+	}
+	b.spoolSync = spoolSync
+
 	dbFilePath := backendURL.Path
 	if dbFilePath == "" {
 		return nil, fmt.Errorf("Invalid SQLite database file path '%s'", dbFilePath)
@@ -57,183 +170,549 @@ func newSQLiteBackend(backendURL *url.URL) (*sqliteBackend, error) {
 
 func (b *sqliteBackend) Start() error {
 
-	var err error
-
-	dbDir := filepath.Dir(b.dbFilePath)
-	err = os.MkdirAll(dbDir, os.ModePerm)
+	err := checkFTS5()
 	if err != nil {
 		return err
 	}
 
-	db, err := sql.Open("sqlite3", b.dbFilePath)
+	dbDir := filepath.Dir(b.dbFilePath)
+	err = os.MkdirAll(dbDir, os.ModePerm)
 	if err != nil {
 		return err
 	}
-	b.db = db
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS logh (ts DATETIME, host VARCHAR(255), app VARCHAR(255))")
-	if err != nil {
-		db.Close()
-		return err
+	if b.archiveDir != "" {
+		b.archiver, err = openArchiver(b.archiveDir)
+		if err != nil {
+			return fmt.Errorf("Unable to open archive '%s': %s", b.archiveDir, err)
+		}
 	}
 
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS logh_idx ON logh (ts, host, app)")
-	if err != nil {
-		db.Close()
-		return err
+	var parts []*partition
+	if b.partitioning == partitionNone {
+		parts = []*partition{{path: b.dbFilePath}}
+	} else {
+		parts, err = b.findPartitions()
+		if err != nil {
+			return err
+		}
 	}
-
-	_, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS logb USING FTS4(msg, tokenize=unicode61)")
-	if err != nil {
-		db.Close()
-		return err
+	for i, p := range parts {
+		err = b.openPartition(p)
+		if err != nil {
+			for _, p := range parts[:i] {
+				p.close()
+			}
+			return fmt.Errorf("Unable to open database '%s': %s", p.path, err)
+		}
 	}
+	b.addPartitions(parts...)
 
-	hStmt, err := db.Prepare("INSERT INTO logh (ts, host, app) VALUES (?, ?, ?)")
-	if err != nil {
-		db.Close()
-		return err
+	if b.spoolDir != "" {
+		sp, err := openSpool(b.spoolDir, int64(b.spoolSize), b.spoolSync)
+		if err != nil {
+			for _, p := range parts {
+				p.close()
+			}
+			return fmt.Errorf("Unable to open spool '%s': %s", b.spoolDir, err)
+		}
+		b.spool = sp
+		metrics.SetGaugeFunc("raftman_backend_spool_size_bytes", "Size of the entries waiting in the backend spool.",
+			func() float64 { return float64(sp.len()) })
+		go sp.run(b.insertQ)
 	}
-	b.hStmt = hStmt
 
-	bStmt, err := db.Prepare("INSERT INTO logb (docid, msg) VALUES (LAST_INSERT_ROWID(), ?)")
-	if err != nil {
-		hStmt.Close()
-		db.Close()
-		return err
-	}
-	b.bStmt = bStmt
+	b.registerQueueMetrics()
 
 	go b.run()
 
+	for i := 0; i < b.readers; i++ {
+		b.readWG.Add(1)
+		go b.read()
+	}
+
 	return nil
 }
 
 func (b *sqliteBackend) Close() error {
 
+	// What was not fed to the insert queue yet stays in the spool
+	if b.spool != nil {
+		if err := b.spool.close(); err != nil {
+			log.Printf("Unable to close spool: %s", err)
+		}
+	}
+
 	cond := sync.NewCond(&sync.Mutex{})
 	cond.L.Lock()
 	b.stopQ <- cond
 	cond.Wait()
 	cond.L.Unlock()
 
-	if b.bStmt != nil {
-		b.bStmt.Close()
-		b.bStmt = nil
+	close(b.readStopQ)
+	b.readWG.Wait()
+
+	b.partsMu.Lock()
+	parts := b.parts
+	b.parts = nil
+	b.partsMu.Unlock()
+	for _, p := range parts {
+		p.close()
+	}
+
+	// The removed partitions may still be archiving
+	for _, p := range b.removing {
+		<-p.removed
+		if p.kept {
+			p.close()
+		}
+	}
+
+	return nil
+}
+
+// Reconfigure applies the options that can be changed while running
+// (batchSize, retention, retentionRules, retentionBatchSize, maxSize and
+// shutdownTimeout). It fails without changing anything if any other option
+// is changed.
+func (b *sqliteBackend) Reconfigure(backendURL *url.URL) error {
+
+	n, err := newSQLiteBackend(backendURL)
+	if err != nil {
+		return err
+	}
+
+	var restart []string
+	if n.dbFilePath != b.dbFilePath {
+		restart = append(restart, "path")
+	}
+	if cap(n.insertQ) != cap(b.insertQ) {
+		restart = append(restart, "insertQueueSize")
+	}
+	if cap(n.queryStatQ) != cap(b.queryStatQ) {
+		restart = append(restart, "queryQueueSize")
+	}
+	if n.timeout != b.timeout {
+		restart = append(restart, "timeout")
+	}
+	if n.readers != b.readers {
+		restart = append(restart, "readers")
+	}
+	if n.tailQueueSize != b.tailQueueSize {
+		restart = append(restart, "tailQueueSize")
+	}
+	if n.exportBatchSize != b.exportBatchSize {
+		restart = append(restart, "exportBatchSize")
+	}
+	if n.overflow.policy != b.overflow.policy {
+		restart = append(restart, "overflow")
+	}
+	if n.overflow.sampleRate != b.overflow.sampleRate {
+		restart = append(restart, "sampleRate")
+	}
+	if n.spoolDir != b.spoolDir {
+		restart = append(restart, "spool")
+	}
+	if n.spoolSize != b.spoolSize {
+		restart = append(restart, "spoolMaxSize")
+	}
+	if n.spoolSync != b.spoolSync {
+		restart = append(restart, "spoolSync")
+	}
+	if n.vacuum != b.vacuum {
+		restart = append(restart, "vacuum")
+	}
+	if n.partitioning != b.partitioning {
+		restart = append(restart, "partition")
 	}
-	if b.hStmt != nil {
-		b.hStmt.Close()
-		b.hStmt = nil
+	if n.archiveDir != b.archiveDir {
+		restart = append(restart, "archive")
 	}
-	if b.db != nil {
-		b.db.Close()
-		b.db = nil
+	if n.backupDir != b.backupDir {
+		restart = append(restart, "backup")
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("changing %s requires a restart", strings.Join(restart, ", "))
 	}
 
+	b.reconfigureQ <- n
 	return nil
 }
 
 func (b *sqliteBackend) Insert(req *api.InsertRequest) (*api.InsertResponse, error) {
 	if req.Entry != nil {
-		b.insertQ <- req.Entry
+		if err := b.enqueue(req.Entry); err != nil {
+			return nil, err
+		}
 	}
 	if len(req.Entries) > 0 {
 		for _, e := range req.Entries {
-			b.insertQ <- e
+			if err := b.enqueue(e); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return &api.InsertResponse{}, nil
 }
 
-func (b *sqliteBackend) QueryStat(req *api.QueryRequest) (*api.QueryStatResponse, error) {
-	return newQueryStatM(req).push(b.queryStatQ).pollWithTimeout(b.timeout)
+func (b *sqliteBackend) enqueue(e *api.LogEntry) error {
+	if b.spool != nil {
+		return b.spool.write(e)
+	}
+	b.overflow.push(b.insertQ, e)
+	return nil
+}
+
+func (b *sqliteBackend) QueryStat(ctx context.Context, req *api.QueryRequest) (*api.QueryStatResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return newQueryStatM(ctx, req).push(b.queryStatQ).poll()
 }
 
-func (b *sqliteBackend) QueryList(req *api.QueryRequest) (*api.QueryListResponse, error) {
-	return newQueryListM(req).push(b.queryListQ).pollWithTimeout(b.timeout)
+func (b *sqliteBackend) QueryList(ctx context.Context, req *api.QueryRequest) (*api.QueryListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return newQueryListM(ctx, req, 256).push(b.queryListQ).poll()
 }
 
+func (b *sqliteBackend) QueryHistogram(ctx context.Context, req *api.QueryRequest) (*api.QueryHistogramResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return newQueryHistogramM(ctx, req).push(b.queryHistogramQ).poll()
+}
+
+func (b *sqliteBackend) QueryContext(ctx context.Context, req *api.QueryContextRequest) (*api.QueryContextResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	return newQueryContextM(ctx, req).push(b.queryContextQ).poll()
+}
+
+// Export calls fn for every entry matching the request. Entries are fetched
+// one batch at a time, so the backend keeps serving other requests between
+// batches, and never holds the whole result in memory.
+func (b *sqliteBackend) Export(ctx context.Context, req *api.QueryRequest, fn func(*api.LogEntry) error) error {
+	batchReq := *req
+	batchReq.Limit = b.exportBatchSize
+	batchReq.Offset = 0
+	for {
+		batchCtx, cancel := context.WithTimeout(ctx, b.timeout)
+		res, err := newQueryListM(batchCtx, &batchReq, b.exportBatchSize).push(b.queryListQ).poll()
+		cancel()
+		if err != nil {
+			return err
+		}
+		if res.Error != "" {
+			return errors.New(res.Error)
+		}
+		for _, e := range res.Entries {
+			if err = fn(e); err != nil {
+				return err
+			}
+		}
+		if res.NextCursor == "" {
+			return nil
+		}
+		batchReq.Cursor = res.NextCursor
+	}
+}
+
+// ListArchives returns the archives of the entries deleted by the retention.
+func (b *sqliteBackend) ListArchives(ctx context.Context) (*api.ArchiveListResponse, error) {
+	if b.archiver == nil {
+		return nil, fmt.Errorf("archive is disabled")
+	}
+	archives, err := b.archiver.list()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ArchiveListResponse{Archives: archives}, nil
+}
+
+func (b *sqliteBackend) Tail(req *api.QueryRequest) (spi.LogTail, error) {
+	return newTailM(req, b.tailQueueSize, b.untailQ).push(b.tailQ), nil
+}
+
+// readyQ is always ready to receive, to keep the run loop calling the
+// batches of a long running task, between the other messages.
+var readyQ = func() chan bool {
+	c := make(chan bool)
+	close(c)
+	return c
+}()
+
 func (b *sqliteBackend) run() {
 	retentionTicker := time.NewTicker(1 * time.Hour)
+	var migrationQ, retentionQ chan bool
+	for _, p := range b.parts {
+		if p.migration != nil {
+			migrationQ = readyQ
+		}
+	}
 	for {
 		select {
 		case e := <-b.insertQ:
 			b.handleInsert(e)
-		case m := <-b.queryStatQ:
-			b.handleQueryStat(m)
-		case m := <-b.queryListQ:
-			b.handleQueryList(m)
+			if len(b.insertQ) == 0 {
+				b.handleDropped()
+			}
+		case m := <-b.tailQ:
+			b.handleTail(m)
+		case m := <-b.untailQ:
+			b.handleUntail(m)
+		case n := <-b.reconfigureQ:
+			b.handleReconfigure(n)
+		case <-b.keptQ:
+			b.forgetRemovedPartitions()
+		case <-migrationQ:
+			if !b.handleSchemaMigration() {
+				migrationQ = nil
+			}
 		case now := <-retentionTicker.C:
-			b.handleRetention(now)
+			if b.handleRetention(now) {
+				retentionQ = readyQ
+			}
+		case <-retentionQ:
+			if !b.handleRetentionBatch() {
+				retentionQ = nil
+			}
 		case cond := <-b.stopQ:
+			b.handleDrain(time.Now().Add(b.shutdownTimeout))
+			for m := range b.tails {
+				b.handleUntail(m)
+			}
 			cond.Broadcast()
 			return
 		}
 	}
 }
 
-func (b *sqliteBackend) handleInsert(e *api.LogEntry) {
+// read serves the queries, on the read-only connections, until Close.
+// Queries whose caller gave up while they were queued are skipped.
+func (b *sqliteBackend) read() {
+	defer b.readWG.Done()
+	for {
+		select {
+		case m := <-b.queryStatQ:
+			if m.ctx.Err() == nil {
+				start := time.Now()
+				b.handleQueryStat(m)
+				observeQuery("stat", start)
+			}
+		case m := <-b.queryListQ:
+			if m.ctx.Err() == nil {
+				start := time.Now()
+				b.handleQueryList(m)
+				observeQuery("list", start)
+			}
+		case m := <-b.queryHistogramQ:
+			if m.ctx.Err() == nil {
+				start := time.Now()
+				b.handleQueryHistogram(m)
+				observeQuery("histogram", start)
+			}
+		case m := <-b.queryContextQ:
+			if m.ctx.Err() == nil {
+				start := time.Now()
+				b.handleQueryContext(m)
+				observeQuery("context", start)
+			}
+		case <-b.readStopQ:
+			return
+		}
+	}
+}
 
-	var err error
+func (b *sqliteBackend) handleReconfigure(n *sqliteBackend) {
+	b.batchSize = n.batchSize
+	b.retention = n.retention
+	b.rules = n.rules
+	b.maxSize = n.maxSize
+	b.chunkSize = n.chunkSize
+	b.shutdownTimeout = n.shutdownTimeout
+}
 
-	tx, err := b.db.Begin()
-	if err != nil {
-		log.Printf("Unable to begin transaction: %s", err)
+// handleDrain commits the entries still queued, until the deadline.
+func (b *sqliteBackend) handleDrain(deadline time.Time) {
+	flushed := 0
+	for len(b.insertQ) > 0 && time.Now().Before(deadline) {
+		flushed += b.handleInsert(<-b.insertQ)
+	}
+	b.handleDropped()
+	if b.spool != nil {
+		log.Printf("Flushed %d queued entries to the backend, left %d in the spool", flushed, len(b.insertQ))
 		return
 	}
+	log.Printf("Flushed %d queued entries to the backend, dropped %d", flushed, len(b.insertQ))
+}
 
-	err = b.handleInsertBatch(tx, e)
-	if err != nil {
-		log.Printf("Unable to insert: %s", err)
-		err = tx.Rollback()
-		if err != nil {
-			log.Printf("Unable to rollback: %s", err)
+// insertRetries is how many times a batch is tried before its entries are
+// dropped, waiting insertRetryDelay more after each failure.
+const (
+	insertRetries    = 5
+	insertRetryDelay = 100 * time.Millisecond
+)
+
+func (b *sqliteBackend) handleInsert(e *api.LogEntry) int {
+
+	batch := b.takeInsertBatch(e)
+
+	for i := 1; ; i++ {
+		txs, err := b.insertBatch(batch)
+		if err == nil {
+			b.ack(len(batch))
+			insertedEntries.Add(uint64(len(batch)))
+			for m := range b.tails {
+				b.notifyTail(m, txs)
+			}
+			return len(batch)
 		}
-		return
+		if i == insertRetries {
+			log.Printf("Unable to insert, dropped %d entries: %s", len(batch), err)
+			b.ack(len(batch))
+			return 0
+		}
+		log.Printf("Unable to insert, retrying %d entries: %s", len(batch), err)
+		time.Sleep(time.Duration(i) * insertRetryDelay)
 	}
+}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Unable to commit transaction: %s", err)
+// takeInsertBatch returns e, followed by up to batchSize entries already
+// waiting in the insert queue.
+func (b *sqliteBackend) takeInsertBatch(e *api.LogEntry) []*api.LogEntry {
+	batch := []*api.LogEntry{e}
+	for i := 0; i < b.batchSize; i++ {
+		select {
+		case e = <-b.insertQ:
+			batch = append(batch, e)
+		default:
+			return batch
+		}
 	}
+	return batch
 }
 
-func (b *sqliteBackend) handleInsertBatch(tx *sql.Tx, e *api.LogEntry) error {
+// insertBatch inserts the entries, and commits them, or none of them.
+func (b *sqliteBackend) insertBatch(entries []*api.LogEntry) (insertTxs, error) {
 
-	var err error
+	txs := insertTxs{}
 
-	err = b.insertEntry(tx, e)
+	for _, e := range entries {
+		if err := b.insertEntry(txs, e); err != nil {
+			rollbacks.Inc()
+			txs.rollback()
+			return nil, err
+		}
+	}
+
+	if err := txs.commit(); err != nil {
+		rollbacks.Inc()
+		return nil, fmt.Errorf("Unable to commit transaction: %s", err)
+	}
+	commits.Inc()
+
+	return txs, nil
+}
+
+// insertTxs are the transactions of an insert batch, one for each partition
+// it inserts into.
+type insertTxs map[*partition]*insertTx
+
+// insertTx is the transaction of a partition, along with the rowid of the
+// last entry it inserted.
+type insertTx struct {
+	*sql.Tx
+	lastID int64
+}
+
+func (txs insertTxs) begin(p *partition) (*insertTx, error) {
+	if tx, ok := txs[p]; ok {
+		return tx, nil
+	}
+	tx, err := p.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	txs[p] = &insertTx{Tx: tx}
+	return txs[p], nil
+}
 
-	for i := 0; i < b.batchSize; i++ {
-		select {
-		case e = <-b.insertQ:
-			err = b.insertEntry(tx, e)
-			if err != nil {
-				return err
-			}
-		default:
-			return nil
+func (txs insertTxs) rollback() {
+	for _, tx := range txs {
+		if err := tx.Rollback(); err != nil {
+			log.Printf("Unable to rollback: %s", err)
+		}
+	}
+}
+
+func (txs insertTxs) commit() error {
+	var err error
+	for _, tx := range txs {
+		if commitErr := tx.Commit(); commitErr != nil && err == nil {
+			err = commitErr
 		}
 	}
+	return err
+}
 
-	return nil
+// ack tells the spool, if any, that n entries were taken from the insert
+// queue, so that they are not read back on the next start.
+func (b *sqliteBackend) ack(n int) {
+	if b.spool != nil {
+		b.spool.ack(n)
+	}
 }
 
-func (b *sqliteBackend) insertEntry(tx *sql.Tx, e *api.LogEntry) error {
-	if _, err := tx.Stmt(b.hStmt).Exec(e.Timestamp, e.Hostname, e.Application); err != nil {
+// handleDropped writes an entry reporting the entries dropped for each host
+// and app since the last time.
+func (b *sqliteBackend) handleDropped() {
+
+	entries := b.overflow.takeDropped()
+	if len(entries) == 0 {
+		return
+	}
+
+	txs, err := b.insertBatch(entries)
+	if err != nil {
+		log.Printf("Unable to insert: %s", err)
+		return
+	}
+	insertedEntries.Add(uint64(len(entries)))
+
+	for m := range b.tails {
+		b.notifyTail(m, txs)
+	}
+}
+
+// insertEntry inserts the entry in the transaction of its partition.
+func (b *sqliteBackend) insertEntry(txs insertTxs, e *api.LogEntry) error {
+	p, err := b.partitionAt(e.Timestamp)
+	if err != nil {
+		return err
+	}
+	tx, err := txs.begin(p)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Stmt(p.hStmt).Exec(e.Timestamp, e.Hostname, e.Application, e.Priority, e.Facility, e.Severity, e.ProcID, e.MsgID, e.StructuredData)
+	if err != nil {
+		return err
+	}
+	rowid, err := res.LastInsertId()
+	if err != nil {
 		return err
 	}
-	if _, err := tx.Stmt(b.bStmt).Exec(e.Message); err != nil {
+	if _, err = tx.Stmt(p.bStmt).Exec(rowid, e.Message); err != nil {
 		return err
 	}
+	tx.lastID = rowid
+	if p.migration != nil && p.migration.insert != nil {
+		return p.migration.insert(tx.Tx, rowid, e.Message)
+	}
 	return nil
 }
 
-func (b *sqliteBackend) buildQueryFromAndWhere(req *api.QueryRequest, sqlBuf *bytes.Buffer, args *[]interface{}) {
-	fmt.Fprint(sqlBuf, "FROM logh AS h JOIN logb AS b ON b.docid = h.rowid ")
+func (b *sqliteBackend) buildQueryFromAndWhere(req *api.QueryRequest, sqlBuf *bytes.Buffer, args *[]interface{}) error {
+	fmt.Fprint(sqlBuf, "FROM logh AS h JOIN logb AS b ON b.rowid = h.rowid ")
 	fmt.Fprint(sqlBuf, "WHERE 1=1 ")
 	if !req.FromTimestamp.IsZero() {
 		fmt.Fprint(sqlBuf, "AND h.ts >= ? ")
@@ -246,15 +725,52 @@ func (b *sqliteBackend) buildQueryFromAndWhere(req *api.QueryRequest, sqlBuf *by
 	if req.Hostname != "" {
 		fmt.Fprint(sqlBuf, "AND h.host = ? ")
 		*args = append(*args, req.Hostname)
-		if req.Application != "" {
-			fmt.Fprint(sqlBuf, "AND h.app = ? ")
-			*args = append(*args, req.Application)
+	}
+	if req.Application != "" {
+		fmt.Fprint(sqlBuf, "AND h.app = ? ")
+		*args = append(*args, req.Application)
+	}
+	if req.Severity != "" {
+		sev, err := utils.ParseSeverity(req.Severity)
+		if err != nil {
+			return err
 		}
+		fmt.Fprint(sqlBuf, "AND h.sev <= ? ")
+		*args = append(*args, sev)
+	}
+	if req.Facility != "" {
+		fac, err := utils.ParseFacility(req.Facility)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(sqlBuf, "AND h.fac = ? ")
+		*args = append(*args, fac)
+	}
+	if req.ProcID != "" {
+		fmt.Fprint(sqlBuf, "AND h.procid = ? ")
+		*args = append(*args, req.ProcID)
+	}
+	if req.MsgID != "" {
+		fmt.Fprint(sqlBuf, "AND h.msgid = ? ")
+		*args = append(*args, req.MsgID)
+	}
+	sq, match, err := b.searchQuery(req)
+	if err != nil {
+		return err
+	}
+	for _, cond := range sq.where {
+		fmt.Fprintf(sqlBuf, "AND %s ", cond)
 	}
-	if req.Message != "" {
-		fmt.Fprint(sqlBuf, "AND b.msg MATCH ? ")
-		*args = append(*args, req.Message)
+	*args = append(*args, sq.args...)
+	if match != "" {
+		fmt.Fprint(sqlBuf, "AND b.logb MATCH ? ")
+		*args = append(*args, match)
 	}
+	if len(sq.exclude) > 0 {
+		fmt.Fprint(sqlBuf, "AND h.rowid NOT IN (SELECT rowid FROM logb WHERE logb MATCH ?) ")
+		*args = append(*args, sq.excludeExpr())
+	}
+	return nil
 }
 
 func clamp(min, v, max int) int {
@@ -278,151 +794,639 @@ func (b *sqliteBackend) handleQueryStat(m *queryStatM) {
 	args := []interface{}{}
 
 	sqlBuf := &bytes.Buffer{}
-	fmt.Fprint(sqlBuf, "SELECT h.host, h.app, COUNT(b.docid) ")
-	b.buildQueryFromAndWhere(m.req, sqlBuf, &args)
-	fmt.Fprint(sqlBuf, "GROUP BY h.host, h.app ")
-	fmt.Fprint(sqlBuf, "ORDER BY h.host, h.app ")
-	b.buildQueryLimit(m.req, sqlBuf, &args)
-
 	res := api.QueryStatResponse{}
 
-	rows, err := b.db.Query(sqlBuf.String(), args...)
-	if err != nil {
+	parts := b.acquirePartitions(m.req.FromTimestamp, m.req.ToTimestamp)
+	defer releasePartitions(parts)
+
+	fmt.Fprint(sqlBuf, "SELECT h.host, h.app, COUNT(b.rowid) ")
+	if err := b.buildQueryFromAndWhere(m.req, sqlBuf, &args); err != nil {
 		res.Error = err.Error()
 		m.res <- &res
 		return
 	}
-	defer rows.Close()
+	fmt.Fprint(sqlBuf, "GROUP BY h.host, h.app ")
+	fmt.Fprint(sqlBuf, "ORDER BY h.host, h.app ")
+	// The counts of several partitions are summed before the limit applies
+	if len(parts) == 1 {
+		b.buildQueryLimit(m.req, sqlBuf, &args)
+	}
 
 	stat := make(map[string]map[string]uint64)
-	for rows.Next() {
+	err := queryPartitions(m.ctx, parts, sqlBuf.String(), args, func(p *partition, rows *sql.Rows) error {
 		var app string
 		var proc string
 		var count uint64
-		err = rows.Scan(&app, &proc, &count)
-		if err != nil {
-			res.Error = err.Error()
-			m.res <- &res
-			return
+		if err := rows.Scan(&app, &proc, &count); err != nil {
+			return err
 		}
 		procs, ok := stat[app]
 		if !ok {
 			procs = make(map[string]uint64)
 			stat[app] = procs
 		}
-		procs[proc] = count
-	}
-
-	err = rows.Err()
+		procs[proc] += count
+		return nil
+	})
 	if err != nil {
 		res.Error = err.Error()
 		m.res <- &res
 		return
 	}
 
+	if len(parts) > 1 {
+		stat = limitStat(stat, clamp(0, m.req.Limit, 256), clamp(0, m.req.Offset, math.MaxInt16))
+	}
+
 	res.Stat = stat
 	m.res <- &res
 }
 
+// limitStat keeps limit of the host and app counts, sorted by host and app,
+// starting at offset.
+func limitStat(stat map[string]map[string]uint64, limit, offset int) map[string]map[string]uint64 {
+
+	type hostApp struct{ host, app string }
+	var keys []hostApp
+	for host, apps := range stat {
+		for app := range apps {
+			keys = append(keys, hostApp{host, app})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].host != keys[j].host {
+			return keys[i].host < keys[j].host
+		}
+		return keys[i].app < keys[j].app
+	})
+
+	limited := make(map[string]map[string]uint64)
+	for i := offset; i < len(keys) && i < offset+limit; i++ {
+		k := keys[i]
+		apps, ok := limited[k.host]
+		if !ok {
+			apps = make(map[string]uint64)
+			limited[k.host] = apps
+		}
+		apps[k.app] = stat[k.host][k.app]
+	}
+	return limited
+}
+
 func (b *sqliteBackend) handleQueryList(m *queryListM) {
 
 	args := []interface{}{}
 
 	sqlBuf := &bytes.Buffer{}
-	fmt.Fprint(sqlBuf, "SELECT h.ts, h.host, h.app, b.msg ")
-	b.buildQueryFromAndWhere(m.req, sqlBuf, &args)
-	fmt.Fprint(sqlBuf, "ORDER BY h.ts DESC ")
-	b.buildQueryLimit(m.req, sqlBuf, &args)
-
 	res := api.QueryListResponse{}
 
-	rows, err := b.db.Query(sqlBuf.String(), args...)
+	relevance, asc, err := parseSort(m.req.Sort)
 	if err != nil {
 		res.Error = err.Error()
 		m.res <- &res
 		return
 	}
-	defer rows.Close()
 
-	entries := make([]*api.LogEntry, 0, clamp(0, m.req.Limit, 500))
-	for rows.Next() {
-		entry := api.LogEntry{}
-		err = rows.Scan(&entry.Timestamp, &entry.Hostname, &entry.Application, &entry.Message)
+	var c *cursor
+	if m.req.Cursor != "" {
+		c, err = parseCursor(m.req.Cursor)
 		if err != nil {
 			res.Error = err.Error()
 			m.res <- &res
 			return
 		}
-		entries = append(entries, &entry)
 	}
 
-	err = rows.Err()
+	// When going backward from a cursor, the entries are fetched in the
+	// opposite order, then reversed back into the requested order
+	backward := c != nil && c.Before
+	if backward {
+		asc = !asc
+	}
+
+	_, match, err := b.searchQuery(m.req)
 	if err != nil {
 		res.Error = err.Error()
 		m.res <- &res
 		return
 	}
 
+	// The matches are only known when searching the message, with the FTS5
+	// index (the FTS4 one may still be in use while migrating)
+	fts5 := match != "" && b.schemaVersion() >= 2
+	highlight := m.req.Highlight && fts5
+	snippet := m.req.Snippet && fts5
+	if relevance && !fts5 {
+		res.Error = "sort 'relevance' requires a Message search on the FTS5 full text index"
+		m.res <- &res
+		return
+	}
+
+	parts := b.acquirePartitions(m.req.FromTimestamp, m.req.ToTimestamp)
+	defer releasePartitions(parts)
+
+	fmt.Fprint(sqlBuf, "SELECT h.rowid, CAST(h.ts AS TEXT), h.ts, h.host, h.app, b.msg, h.prio, h.fac, h.sev, h.procid, h.msgid, h.sd ")
+	if relevance {
+		fmt.Fprintf(sqlBuf, ", %s ", sqlRank)
+	}
+	if highlight {
+		fmt.Fprintf(sqlBuf, ", %s ", sqlHighlight)
+	}
+	if snippet {
+		fmt.Fprintf(sqlBuf, ", %s ", sqlSnippet)
+	}
+	if err = b.buildQueryFromAndWhere(m.req, sqlBuf, &args); err != nil {
+		res.Error = err.Error()
+		m.res <- &res
+		return
+	}
+
+	// One more entry than the limit is fetched to know if there are more.
+	// The entries of several partitions are merged before the offset applies.
+	limit := clamp(0, m.req.Limit, m.maxLimit)
+	offset := clamp(0, m.req.Offset, math.MaxInt16)
+	n, sqlOffset := offset+limit+1, 0
+	if len(parts) == 1 {
+		n, sqlOffset = limit+1, offset
+	}
+
+	build := func(p *partition) (string, []interface{}) {
+		sqlBuf := bytes.NewBufferString(sqlBuf.String())
+		args := append([]interface{}{}, args...)
+		if c != nil {
+			b.buildQueryCursor(p, c, relevance, asc, sqlBuf, &args)
+		}
+		// The most relevant entries have the lowest rank, the newest first
+		switch {
+		case relevance && asc:
+			fmt.Fprintf(sqlBuf, "ORDER BY %s ASC, h.rowid DESC ", sqlRank)
+		case relevance:
+			fmt.Fprintf(sqlBuf, "ORDER BY %s DESC, h.rowid ASC ", sqlRank)
+		case asc:
+			fmt.Fprint(sqlBuf, "ORDER BY h.ts ASC, h.rowid ASC ")
+		default:
+			fmt.Fprint(sqlBuf, "ORDER BY h.ts DESC, h.rowid DESC ")
+		}
+		fmt.Fprint(sqlBuf, "LIMIT ? OFFSET ? ")
+		args = append(args, n, sqlOffset)
+		return sqlBuf.String(), args
+	}
+
+	scan := func(p *partition, rows *sql.Rows) (*listRow, error) {
+		entry := api.LogEntry{}
+		pos := cursor{}
+		var highlighted, snippeted string
+		dest := []interface{}{&entry.ID, &pos.TS, &entry.Timestamp, &entry.Hostname, &entry.Application, &entry.Message,
+			&entry.Priority, &entry.Facility, &entry.Severity, &entry.ProcID, &entry.MsgID, &entry.StructuredData}
+		if relevance {
+			dest = append(dest, &pos.Rank)
+		}
+		if highlight {
+			dest = append(dest, &highlighted)
+		}
+		if snippet {
+			dest = append(dest, &snippeted)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if highlight {
+			_, entry.Matches = parseMarkedMatches(highlighted)
+		}
+		if snippet {
+			entry.Snippet, entry.SnippetMatches = parseMarkedMatches(snippeted)
+		}
+		entry.ID = p.id(entry.ID)
+		pos.ID = entry.ID
+		return &listRow{&entry, &pos}, nil
+	}
+
+	list, err := fetchRows(m.ctx, parts, relevance, asc, n, build, scan)
+	if err != nil {
+		res.Error = err.Error()
+		m.res <- &res
+		return
+	}
+	if len(parts) > 1 {
+		list = list[clamp(0, offset, len(list)):]
+	}
+
+	more := len(list) > limit
+	if more {
+		list = list[:limit]
+	}
+
+	entries := make([]*api.LogEntry, len(list))
+	cursors := make([]*cursor, len(list))
+	for i, row := range list {
+		entries[i], cursors[i] = row.entry, row.pos
+	}
+
+	if backward {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+	}
+
+	// There are entries on the side we came from, and maybe more on the
+	// side we are going to
+	if len(entries) > 0 {
+		if (c != nil && !backward) || (backward && more) {
+			first := *cursors[0]
+			first.Before = true
+			res.PrevCursor = first.String()
+		}
+		if (!backward && more) || backward {
+			last := *cursors[len(cursors)-1]
+			last.Before = false
+			res.NextCursor = last.String()
+		}
+	}
+
 	res.Entries = entries
 	m.res <- &res
 }
 
-func (b *sqliteBackend) handleRetention(now time.Time) {
+// handleQueryContext returns the entry with the requested ID, along with
+// the entries of the same host and app just before and after it.
+func (b *sqliteBackend) handleQueryContext(m *queryContextM) {
+
+	res := api.QueryContextResponse{}
 
-	if b.retention == utils.INF {
-		// Keep all the things!
+	parts := b.acquirePartitions(time.Time{}, time.Time{})
+	defer releasePartitions(parts)
+
+	var p *partition
+	for _, q := range parts {
+		if q.key == m.req.ID>>partitionIDShift {
+			p = q
+		}
+	}
+
+	var ts string
+	var t time.Time
+	var host, app string
+	err := sql.ErrNoRows
+	if p != nil {
+		err = p.rdb.QueryRowContext(m.ctx, "SELECT CAST(ts AS TEXT), ts, host, app FROM logh WHERE rowid = ?",
+			p.rowidBound(m.req.ID)).Scan(&ts, &t, &host, &app)
+	}
+	if err == sql.ErrNoRows {
+		res.Error = fmt.Sprintf("no entry with ID %d", m.req.ID)
+		m.res <- &res
+		return
+	}
+	if err != nil {
+		res.Error = err.Error()
+		m.res <- &res
 		return
 	}
 
-	upto := now.Add(-time.Duration(b.retention))
+	const sqlSelect = "SELECT h.rowid, CAST(h.ts AS TEXT), h.ts, h.host, h.app, b.msg, h.prio, h.fac, h.sev, h.procid, h.msgid, h.sd " +
+		"FROM logh AS h JOIN logb AS b ON b.rowid = h.rowid " +
+		"WHERE h.host = ? AND h.app = ? "
 
-	tx, err := b.db.Begin()
+	before, err := fetchRows(m.ctx, overlapping(parts, time.Time{}, t.Add(time.Nanosecond)), false, false, clamp(0, m.req.Before, 256),
+		func(p *partition) (string, []interface{}) {
+			return sqlSelect + "AND (h.ts < ? OR (h.ts = ? AND h.rowid < ?)) ORDER BY h.ts DESC, h.rowid DESC LIMIT ?",
+				[]interface{}{host, app, ts, ts, p.rowidBound(m.req.ID), clamp(0, m.req.Before, 256)}
+		}, scanEntry)
 	if err != nil {
-		log.Printf("Unable to begin transaction: %s", err)
+		res.Error = err.Error()
+		m.res <- &res
 		return
 	}
 
-	err = b.handleRetentionBatch(tx, upto)
+	after, err := fetchRows(m.ctx, overlapping(parts, t, time.Time{}), false, true, clamp(0, m.req.After, 256)+1,
+		func(p *partition) (string, []interface{}) {
+			return sqlSelect + "AND (h.ts > ? OR (h.ts = ? AND h.rowid >= ?)) ORDER BY h.ts ASC, h.rowid ASC LIMIT ?",
+				[]interface{}{host, app, ts, ts, p.rowidBound(m.req.ID), clamp(0, m.req.After, 256) + 1}
+		}, scanEntry)
 	if err != nil {
-		log.Printf("Unable to delete: %s", err)
-		err = tx.Rollback()
-		if err != nil {
-			log.Printf("Unable to rollback: %s", err)
-		}
+		res.Error = err.Error()
+		m.res <- &res
 		return
 	}
 
-	err = tx.Commit()
+	entries := make([]*api.LogEntry, 0, len(before)+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		entries = append(entries, before[i].entry)
+	}
+	for _, row := range after {
+		entries = append(entries, row.entry)
+	}
+
+	res.Entries = entries
+	m.res <- &res
+}
+
+// scanEntry scans a row selecting the rowid, the text timestamp, and the
+// columns of an entry.
+func scanEntry(p *partition, rows *sql.Rows) (*listRow, error) {
+	entry := api.LogEntry{}
+	pos := cursor{}
+	err := rows.Scan(&entry.ID, &pos.TS, &entry.Timestamp, &entry.Hostname, &entry.Application, &entry.Message,
+		&entry.Priority, &entry.Facility, &entry.Severity, &entry.ProcID, &entry.MsgID, &entry.StructuredData)
 	if err != nil {
-		log.Printf("Unable to commit transaction: %s", err)
+		return nil, err
 	}
+	entry.ID = p.id(entry.ID)
+	pos.ID = entry.ID
+	return &listRow{&entry, &pos}, nil
 }
 
-func (b *sqliteBackend) handleRetentionBatch(tx *sql.Tx, upto time.Time) error {
+var histogramIntervals = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 7 * 24 * time.Hour,
+}
 
-	var err error
+// histogramInterval returns the smallest interval that splits the span
+// into at most 120 buckets.
+func histogramInterval(span time.Duration) time.Duration {
+	for _, d := range histogramIntervals {
+		if span/d <= 120 {
+			return d
+		}
+	}
+	return histogramIntervals[len(histogramIntervals)-1]
+}
+
+// histogramMaxBuckets is the number of buckets an histogram may have for
+// each group.
+const histogramMaxBuckets = 10000
 
-	rows, err := tx.Query("SELECT rowid FROM logh AS h WHERE h.ts < ?", upto)
+func (b *sqliteBackend) handleQueryHistogram(m *queryHistogramM) {
+
+	res := api.QueryHistogramResponse{}
+
+	var groupBy string
+	switch m.req.GroupBy {
+	case "":
+		groupBy = "'*'"
+	case "host":
+		groupBy = "h.host"
+	case "app":
+		groupBy = "h.app"
+	default:
+		res.Error = fmt.Sprintf("invalid group by '%s'", m.req.GroupBy)
+		m.res <- &res
+		return
+	}
+
+	parts := b.acquirePartitions(m.req.FromTimestamp, m.req.ToTimestamp)
+	defer releasePartitions(parts)
+
+	span, err := b.querySpan(m.ctx, parts, m.req)
 	if err != nil {
-		return err
+		res.Error = err.Error()
+		m.res <- &res
+		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var rowid uint64
-		err = rows.Scan(&rowid)
+	var interval time.Duration
+	if m.req.Interval != "" {
+		interval, err = time.ParseDuration(m.req.Interval)
 		if err != nil {
+			res.Error = err.Error()
+			m.res <- &res
+			return
+		}
+		if interval < time.Second {
+			res.Error = fmt.Sprintf("invalid interval '%s', must be at least 1s", m.req.Interval)
+			m.res <- &res
+			return
+		}
+		if span/interval >= histogramMaxBuckets {
+			res.Error = fmt.Sprintf("invalid interval '%s', must split the %s span into at most %d buckets", m.req.Interval, span, histogramMaxBuckets)
+			m.res <- &res
+			return
+		}
+	} else {
+		interval = histogramInterval(span)
+	}
+	secs := int64(interval / time.Second)
+
+	args := []interface{}{secs, secs}
+
+	sqlBuf := &bytes.Buffer{}
+	fmt.Fprintf(sqlBuf, "SELECT CAST(strftime('%%s', h.ts) AS INTEGER) / ? * ? AS bucket, %s, COUNT(b.rowid) ", groupBy)
+	if err := b.buildQueryFromAndWhere(m.req, sqlBuf, &args); err != nil {
+		res.Error = err.Error()
+		m.res <- &res
+		return
+	}
+	fmt.Fprintf(sqlBuf, "GROUP BY bucket, %s ", groupBy)
+	fmt.Fprint(sqlBuf, "ORDER BY bucket ")
+
+	// A bucket may span several partitions
+	counts := make(map[string]map[int64]uint64)
+	err = queryPartitions(m.ctx, parts, sqlBuf.String(), args, func(p *partition, rows *sql.Rows) error {
+		var bucket int64
+		var key string
+		var count uint64
+		if err := rows.Scan(&bucket, &key, &count); err != nil {
 			return err
 		}
-		_, err = tx.Exec("DELETE FROM logh WHERE rowid = ?", rowid)
+		buckets, ok := counts[key]
+		if !ok {
+			buckets = make(map[int64]uint64)
+			counts[key] = buckets
+		}
+		buckets[bucket] += count
+		return nil
+	})
+	if err != nil {
+		res.Error = err.Error()
+		m.res <- &res
+		return
+	}
+
+	histogram := make(map[string][]*api.HistogramBucket)
+	for key, buckets := range counts {
+		for bucket, count := range buckets {
+			histogram[key] = append(histogram[key], &api.HistogramBucket{Timestamp: time.Unix(bucket, 0).UTC(), Count: count})
+		}
+		sort.Slice(histogram[key], func(i, j int) bool {
+			return histogram[key][i].Timestamp.Before(histogram[key][j].Timestamp)
+		})
+	}
+
+	res.Interval = interval.String()
+	res.Histogram = histogram
+	m.res <- &res
+}
+
+// querySpan returns the time span covered by the request, using the oldest
+// and newest matching entries for the bounds that are not set.
+func (b *sqliteBackend) querySpan(ctx context.Context, parts []*partition, req *api.QueryRequest) (time.Duration, error) {
+
+	from, to := req.FromTimestamp.Unix(), req.ToTimestamp.Unix()
+	if req.FromTimestamp.IsZero() || req.ToTimestamp.IsZero() {
+
+		args := []interface{}{}
+
+		sqlBuf := &bytes.Buffer{}
+		fmt.Fprintf(sqlBuf, "SELECT MIN(CAST(strftime('%%s', h.ts) AS INTEGER)), MAX(CAST(strftime('%%s', h.ts) AS INTEGER)) ")
+		if err := b.buildQueryFromAndWhere(req, sqlBuf, &args); err != nil {
+			return 0, err
+		}
+
+		var min, max sql.NullInt64
+		err := queryPartitions(ctx, parts, sqlBuf.String(), args, func(p *partition, rows *sql.Rows) error {
+			var pmin, pmax sql.NullInt64
+			if err := rows.Scan(&pmin, &pmax); err != nil {
+				return err
+			}
+			if pmin.Valid && (!min.Valid || pmin.Int64 < min.Int64) {
+				min = pmin
+			}
+			if pmax.Valid && (!max.Valid || pmax.Int64 > max.Int64) {
+				max = pmax
+			}
+			return nil
+		})
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if req.FromTimestamp.IsZero() {
+			from = min.Int64
 		}
-		_, err = tx.Exec("DELETE FROM logb WHERE docid = ?", rowid)
+		if req.ToTimestamp.IsZero() {
+			to = max.Int64
+		}
+	}
+
+	return time.Duration(to-from) * time.Second, nil
+}
+
+// parseSort returns whether the entries are sorted by relevance, and
+// whether they are sorted in ascending order (always, for the relevance).
+func parseSort(sort string) (bool, bool, error) {
+	switch sort {
+	case "", "time_desc":
+		return false, false, nil
+	case "time_asc":
+		return false, true, nil
+	case "relevance":
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("invalid sort '%s'", sort)
+}
+
+// buildQueryCursor restricts the query of the partition to the entries that
+// come after the cursor in the given order.
+func (b *sqliteBackend) buildQueryCursor(p *partition, c *cursor, relevance, asc bool, sqlBuf *bytes.Buffer, args *[]interface{}) {
+	rowid := p.rowidBound(c.ID)
+	switch {
+	case relevance && asc:
+		fmt.Fprintf(sqlBuf, "AND (%s > ? OR (%s = ? AND h.rowid < ?)) ", sqlRank, sqlRank)
+		*args = append(*args, c.Rank, c.Rank, rowid)
+	case relevance:
+		fmt.Fprintf(sqlBuf, "AND (%s < ? OR (%s = ? AND h.rowid > ?)) ", sqlRank, sqlRank)
+		*args = append(*args, c.Rank, c.Rank, rowid)
+	case asc:
+		fmt.Fprint(sqlBuf, "AND (h.ts > ? OR (h.ts = ? AND h.rowid > ?)) ")
+		*args = append(*args, c.TS, c.TS, rowid)
+	default:
+		fmt.Fprint(sqlBuf, "AND (h.ts < ? OR (h.ts = ? AND h.rowid < ?)) ")
+		*args = append(*args, c.TS, c.TS, rowid)
+	}
+}
+
+func (b *sqliteBackend) handleTail(m *tailM) {
+	m.lastIDs = make(map[int64]int64)
+	for _, p := range b.parts {
+		lastID, err := p.lastRowID()
 		if err != nil {
-			return err
+			log.Printf("Unable to start tail: %s", err)
+			close(m.entries)
+			return
+		}
+		m.lastIDs[p.key] = lastID
+	}
+	b.tails[m] = true
+}
+
+func (b *sqliteBackend) handleUntail(m *tailM) {
+	if b.tails[m] {
+		delete(b.tails, m)
+		close(m.entries)
+	}
+}
+
+// notifyTail sends the entries inserted in the partitions of the
+// transactions since the last notification that match the tail filter. It
+// never blocks: entries that do not fit in the tail queue are sent on a
+// later notification, once the consumer caught up.
+func (b *sqliteBackend) notifyTail(m *tailM, txs insertTxs) {
+	for p, tx := range txs {
+		if !b.notifyTailPartition(m, p, tx.lastID) {
+			return
 		}
 	}
+}
 
-	return nil
+// notifyTailPartition sends the entries of the partition up to lastID, the
+// last one just committed, and returns false if the tail is full or closed.
+// Only the rows inserted since the last notification are searched, so a
+// tail matching few entries does not search the same rows again and again.
+func (b *sqliteBackend) notifyTailPartition(m *tailM, p *partition, lastID int64) bool {
+
+	room := cap(m.entries) - len(m.entries)
+	if room == 0 {
+		return false
+	}
+
+	args := []interface{}{}
+
+	sqlBuf := &bytes.Buffer{}
+	fmt.Fprint(sqlBuf, "SELECT h.rowid, h.ts, h.host, h.app, b.msg, h.prio, h.fac, h.sev, h.procid, h.msgid, h.sd ")
+	if err := b.buildQueryFromAndWhere(m.req, sqlBuf, &args); err != nil {
+		log.Printf("Unable to tail: %s", err)
+		b.handleUntail(m)
+		return false
+	}
+	// The bounds are on both tables, so that the full text index only
+	// searches the new rows
+	fmt.Fprint(sqlBuf, "AND h.rowid > ? AND h.rowid <= ? AND b.rowid > ? AND b.rowid <= ? ")
+	fmt.Fprint(sqlBuf, "ORDER BY h.rowid ")
+	fmt.Fprint(sqlBuf, "LIMIT ? ")
+	args = append(args, m.lastIDs[p.key], lastID, m.lastIDs[p.key], lastID, room)
+
+	rows, err := p.db.Query(sqlBuf.String(), args...)
+	if err != nil {
+		log.Printf("Unable to tail: %s", err)
+		b.handleUntail(m)
+		return false
+	}
+	defer rows.Close()
+
+	sent := 0
+	for rows.Next() {
+		entry := api.LogEntry{}
+		err = rows.Scan(&entry.ID, &entry.Timestamp, &entry.Hostname, &entry.Application, &entry.Message,
+			&entry.Priority, &entry.Facility, &entry.Severity, &entry.ProcID, &entry.MsgID, &entry.StructuredData)
+		if err != nil {
+			log.Printf("Unable to tail: %s", err)
+			return false
+		}
+		m.lastIDs[p.key] = entry.ID
+		entry.ID = p.id(entry.ID)
+		m.entries <- &entry
+		sent++
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Unable to tail: %s", err)
+		return true
+	}
+
+	// All the rows up to lastID were searched
+	if sent < room {
+		m.lastIDs[p.key] = lastID
+	}
+	return true
 }
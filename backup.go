@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/backend"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// backup asks a running raftman to take a backup, through its API, ie:
+//
+//	raftman backup -api http://localhost:8181/api/ -compress
+func backup(args []string) error {
+
+	var apiURL string
+	var compress bool
+
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.StringVar(&apiURL, "api", "http://localhost:8181/api/", "API frontend URL")
+	fs.BoolVar(&compress, "compress", false, "Gzip the database files")
+	fs.Parse(args)
+
+	body, err := json.Marshal(&api.BackupRequest{Compress: compress})
+	if err != nil {
+		return err
+	}
+
+	r, err := http.Post(strings.TrimSuffix(apiURL, "/")+"/backup", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to backup: %s", err)
+	}
+	defer r.Body.Close()
+
+	res := api.BackupResponse{}
+	if err = json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return fmt.Errorf("Unable to backup: %s %s", r.Status, err)
+	}
+	if res.Error != "" {
+		return fmt.Errorf("Unable to backup: %s", res.Error)
+	}
+
+	log.Printf("Backed up %d database files (%d bytes) to '%s'", len(res.Backup.Files), res.Backup.Size, res.Backup.Name)
+	return nil
+}
+
+// restore puts back the database files of a backup, while raftman is
+// stopped, ie:
+//
+//	raftman restore -backend sqlite:///var/lib/raftman/logs.db /var/lib/raftman/backup/backup-20170601T120000Z
+func restore(args []string) error {
+
+	var backendArgs URLValues
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Var(&backendArgs, "backend", "Backend URL")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore -backend URL BACKUP\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(backendArgs) != 1 {
+		return fmt.Errorf("Exactly one backend must be defined")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Exactly one backup must be given")
+	}
+
+	return backend.Restore(backendArgs[0], fs.Arg(0))
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"sort"
+)
+
+// Endpoint is a backend or a frontend, described by its URL, and options
+// that are merged into the URL query (which can also hold them directly).
+type Endpoint struct {
+	URL     string            `yaml:"url"`
+	Options map[string]string `yaml:"options"`
+}
+
+// Config describes a whole raftman instance. For example:
+//
+//	backend:
+//	  url: sqlite:///var/lib/raftman/logs.db
+//	  options:
+//	    retention: 2w
+//	frontends:
+//	  - url: syslog+udp://:514
+//	    options:
+//	      format: RFC5424
+//	  - url: api+http://:8181/api/
+type Config struct {
+	Backend   *Endpoint   `yaml:"backend"`
+	Frontends []*Endpoint `yaml:"frontends"`
+}
+
+// Load reads and parses the config file, rejecting unknown keys.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Config{}
+	if err = yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file '%s': %s", path, err)
+	}
+	return &c, nil
+}
+
+// BackendURL returns the backend URL, or nil if there is none.
+func (c *Config) BackendURL() (*url.URL, error) {
+	if c.Backend == nil {
+		return nil, nil
+	}
+	u, err := c.Backend.url()
+	if err != nil {
+		return nil, fmt.Errorf("backend: %s", err)
+	}
+	return u, nil
+}
+
+// FrontendURLs returns the frontend URLs, in order.
+func (c *Config) FrontendURLs() ([]*url.URL, error) {
+	var urls []*url.URL
+	for i, f := range c.Frontends {
+		if f == nil {
+			return nil, fmt.Errorf("frontends[%d]: empty frontend", i)
+		}
+		u, err := f.url()
+		if err != nil {
+			return nil, fmt.Errorf("frontends[%d]: %s", i, err)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+func (e *Endpoint) url() (*url.URL, error) {
+
+	if e.URL == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url '%s': %s", e.URL, err)
+	}
+
+	if len(e.Options) > 0 {
+		q := u.Query()
+		names := make([]string, 0, len(e.Options))
+		for name := range e.Options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := q[name]; ok {
+				return nil, fmt.Errorf("option '%s' is set both in url '%s' and in options", name, e.URL)
+			}
+			q.Set(name, e.Options[name])
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	return u, nil
+}
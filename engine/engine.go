@@ -9,18 +9,30 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 )
 
+// Loader returns the backend and frontend URLs the engine must run.
+type Loader func() (*url.URL, []*url.URL, error)
+
 type engine struct {
+	mu        sync.Mutex
+	load      Loader
 	backURL   *url.URL
 	frontURLs []*url.URL
 	back      spi.LogBackend
 	fronts    []spi.LogFrontend
 }
 
-func NewEngine(backendURL *url.URL, frontendURLs []*url.URL) (spi.LogEngine, error) {
+func NewEngine(load Loader) (spi.LogEngine, error) {
+
+	backendURL, frontendURLs, err := load()
+	if err != nil {
+		return nil, err
+	}
 
-	e := engine{}
+	e := engine{load: load}
 
 	b, err := backend.NewBackend(&e, backendURL)
 	if err != nil {
@@ -58,32 +70,164 @@ func (e *engine) Start() error {
 	return nil
 }
 
+// Close closes the frontends first, so that they stop receiving and send
+// what they have queued to the backend, then closes the backend.
 func (e *engine) Close() error {
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	for i, f := range e.fronts {
+		log.Printf("Close frontend '%s'", e.frontURLs[i])
 		if err := f.Close(); err != nil {
-			fmt.Printf("Unable to close frontend '%s': %s", e.frontURLs[i], err)
+			log.Printf("Unable to close frontend '%s': %s", e.frontURLs[i], err)
 		}
 	}
 
+	log.Printf("Close backend '%s'", e.backURL)
 	if err := e.back.Close(); err != nil {
-		fmt.Printf("Unable to start backend '%s': %s", e.backURL, err)
+		log.Printf("Unable to close backend '%s': %s", e.backURL, err)
 	}
 
 	return nil
 }
 
+// Wait blocks until the process is asked to stop, reloading the
+// configuration each time it receives SIGHUP.
 func (e *engine) Wait() error {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range c {
+		if s == syscall.SIGHUP {
+			log.Printf("Received %s, reloading", s)
+			if err := e.Reload(); err != nil {
+				log.Printf("Unable to reload: %s", err)
+			}
+			continue
+		}
+		log.Printf("Received %s, shutting down", s)
+		break
+	}
 	return nil
 }
 
+// Reload loads the configuration again and applies the differences: the
+// backend options are changed in place, the removed (or changed) frontends
+// are closed, the new (or changed) ones started, and the others untouched.
+// A frontend that can not be created or started leaves the one it replaces
+// running.
+func (e *engine) Reload() error {
+
+	backendURL, frontendURLs, err := e.load()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if backendURL.String() != e.backURL.String() {
+		if backendURL.Scheme != e.backURL.Scheme || backendURL.Host != e.backURL.Host || backendURL.Path != e.backURL.Path {
+			log.Printf("Unable to reconfigure backend '%s' to '%s': changing the backend requires a restart", e.backURL, backendURL)
+		} else if err := e.back.Reconfigure(backendURL); err != nil {
+			log.Printf("Unable to reconfigure backend '%s' to '%s': %s", e.backURL, backendURL, err)
+		} else {
+			log.Printf("Reconfigured backend '%s' to '%s'", e.backURL, backendURL)
+			e.backURL = backendURL
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, frontendURL := range frontendURLs {
+		wanted[frontendURL.String()] = true
+	}
+	running := make(map[string]bool)
+	for _, frontendURL := range e.frontURLs {
+		running[frontendURL.String()] = true
+	}
+
+	// Create the new frontends first, which checks their options without
+	// taking their address, and remember the addresses of those that fail
+	var newURLs []*url.URL
+	var news []spi.LogFrontend
+	failed := make(map[string]bool)
+	for _, frontendURL := range frontendURLs {
+		if running[frontendURL.String()] {
+			continue
+		}
+		f, err := frontend.NewFrontend(e, frontendURL)
+		if err != nil {
+			log.Printf("Unable to create frontend '%s': %s", frontendURL, err)
+			failed[frontendURL.Host] = true
+			continue
+		}
+		newURLs = append(newURLs, frontendURL)
+		news = append(news, f)
+	}
+
+	// Close the removed frontends, to free their addresses, but those on the
+	// address of a new frontend that failed
+	var keptURLs []*url.URL
+	var kept []spi.LogFrontend
+	closed := make(map[string]*url.URL)
+	for i, f := range e.fronts {
+		frontendURL := e.frontURLs[i]
+		if !wanted[frontendURL.String()] {
+			if !failed[frontendURL.Host] {
+				log.Printf("Close frontend '%s'", frontendURL)
+				if err := f.Close(); err != nil {
+					log.Printf("Unable to close frontend '%s': %s", frontendURL, err)
+				}
+				closed[frontendURL.Host] = frontendURL
+				continue
+			}
+			log.Printf("Keep frontend '%s'", frontendURL)
+		}
+		keptURLs = append(keptURLs, frontendURL)
+		kept = append(kept, f)
+	}
+	e.frontURLs = keptURLs
+	e.fronts = kept
+
+	for i, f := range news {
+		log.Printf("Start frontend '%s'", newURLs[i])
+		if err := f.Start(); err != nil {
+			log.Printf("Unable to start frontend '%s': %s", newURLs[i], err)
+			if old, ok := closed[newURLs[i].Host]; ok {
+				delete(closed, newURLs[i].Host)
+				e.restartFrontend(old)
+			}
+			continue
+		}
+		e.frontURLs = append(e.frontURLs, newURLs[i])
+		e.fronts = append(e.fronts, f)
+	}
+
+	return nil
+}
+
+// restartFrontend starts again a frontend closed for one that failed to
+// start.
+func (e *engine) restartFrontend(frontendURL *url.URL) {
+	log.Printf("Restart frontend '%s'", frontendURL)
+	f, err := frontend.NewFrontend(e, frontendURL)
+	if err == nil {
+		err = f.Start()
+	}
+	if err != nil {
+		log.Printf("Unable to restart frontend '%s': %s", frontendURL, err)
+		return
+	}
+	e.frontURLs = append(e.frontURLs, frontendURL)
+	e.fronts = append(e.fronts, f)
+}
+
 func (e *engine) GetBackend() (*url.URL, spi.LogBackend) {
 	return e.backURL, e.back
 }
 
 func (e *engine) GetFrontends() ([]*url.URL, []spi.LogFrontend) {
-	return e.frontURLs, e.fronts
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*url.URL{}, e.frontURLs...), append([]spi.LogFrontend{}, e.fronts...)
 }
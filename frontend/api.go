@@ -1,11 +1,18 @@
 package frontend
 
 import (
+	"compress/gzip"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"github.com/pierredavidbelanger/raftman/api"
 	"github.com/pierredavidbelanger/raftman/spi"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 type apiFrontend struct {
@@ -24,6 +31,12 @@ func (f *apiFrontend) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc(f.path+"stat", f.handleStat)
 	mux.HandleFunc(f.path+"list", f.handleList)
+	mux.HandleFunc(f.path+"histogram", f.handleHistogram)
+	mux.HandleFunc(f.path+"context", f.handleContext)
+	mux.HandleFunc(f.path+"tail", f.handleTail)
+	mux.HandleFunc(f.path+"export", f.handleExport)
+	mux.HandleFunc(f.path+"archive", f.handleArchive)
+	mux.HandleFunc(f.path+"backup", f.handleBackup)
 	return f.startHandler(mux)
 }
 
@@ -44,7 +57,7 @@ func (f *apiFrontend) handleStat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	res, err := f.b.QueryStat(&req)
+	res, err := f.b.QueryStat(r.Context(), &req)
 	if err != nil {
 		res = &api.QueryStatResponse{Error: err.Error()}
 		w.WriteHeader(400)
@@ -70,7 +83,7 @@ func (f *apiFrontend) handleList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	res, err := f.b.QueryList(&req)
+	res, err := f.b.QueryList(r.Context(), &req)
 	if err != nil {
 		res = &api.QueryListResponse{Error: err.Error()}
 		w.WriteHeader(400)
@@ -82,3 +95,238 @@ func (f *apiFrontend) handleList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (f *apiFrontend) handleContext(w http.ResponseWriter, r *http.Request) {
+
+	req := api.QueryContextRequest{}
+
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	res, err := f.b.QueryContext(r.Context(), &req)
+	if err != nil {
+		res = &api.QueryContextResponse{Error: err.Error()}
+		w.WriteHeader(400)
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (f *apiFrontend) handleHistogram(w http.ResponseWriter, r *http.Request) {
+
+	req := api.QueryRequest{}
+
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	res, err := f.b.QueryHistogram(r.Context(), &req)
+	if err != nil {
+		res = &api.QueryHistogramResponse{Error: err.Error()}
+		w.WriteHeader(400)
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+// handleArchive lists the archives of the entries deleted by the retention.
+func (f *apiFrontend) handleArchive(w http.ResponseWriter, r *http.Request) {
+
+	res, err := f.b.ListArchives(r.Context())
+	if err != nil {
+		res = &api.ArchiveListResponse{Error: err.Error()}
+		w.WriteHeader(400)
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+// handleBackup takes a backup of the database, which may take a while.
+func (f *apiFrontend) handleBackup(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "A backup must be taken with POST", 405)
+		return
+	}
+
+	req := api.BackupRequest{}
+	defer r.Body.Close()
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res, err := f.b.Backup(r.Context(), &req)
+	if err != nil {
+		res = &api.BackupResponse{Error: err.Error()}
+		w.WriteHeader(400)
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+// handleTail streams the entries matching the request as they are inserted,
+// as Server-Sent Events (one JSON encoded entry per event).
+func (f *apiFrontend) handleTail(w http.ResponseWriter, r *http.Request) {
+
+	req := api.QueryRequest{}
+
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+
+	t, err := f.b.Tail(&req)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	defer t.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case entry, ok := <-t.Entries():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleExport streams all the entries matching the request, with no limit,
+// as newline delimited JSON (format=ndjson, the default), gzipped newline
+// delimited JSON (format=jsonl.gz) or CSV (format=csv).
+func (f *apiFrontend) handleExport(w http.ResponseWriter, r *http.Request) {
+
+	req := api.QueryRequest{}
+
+	if r.Method == "POST" {
+		defer r.Body.Close()
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	var write func(*api.LogEntry) error
+	var flush func() error
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(e *api.LogEntry) error { return enc.Encode(e) }
+		flush = func() error { return nil }
+	case "jsonl.gz":
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.jsonl.gz"`)
+		gz := gzip.NewWriter(w)
+		enc := json.NewEncoder(gz)
+		write = func(e *api.LogEntry) error { return enc.Encode(e) }
+		flush = gz.Close
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"Timestamp", "Hostname", "Application", "Priority", "Facility", "Severity", "ProcID", "MsgID", "StructuredData", "Message"})
+		write = func(e *api.LogEntry) error {
+			return cw.Write([]string{
+				e.Timestamp.Format(time.RFC3339Nano), e.Hostname, e.Application,
+				strconv.Itoa(e.Priority), strconv.Itoa(e.Facility), strconv.Itoa(e.Severity),
+				e.ProcID, e.MsgID, e.StructuredData, e.Message,
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid export format '%s'", format), 400)
+		return
+	}
+
+	var written bool
+	err := f.b.Export(r.Context(), &req, func(e *api.LogEntry) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		written = true
+		return write(e)
+	})
+	if err != nil {
+		if !written {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// Headers are already sent, all we can do is to truncate the
+		// response so the client notices something is wrong
+		log.Printf("Unable to export: %s", err)
+		return
+	}
+
+	if err = flush(); err != nil {
+		log.Printf("Unable to export: %s", err)
+	}
+}
@@ -8,12 +8,20 @@ import (
 
 func NewFrontend(e spi.LogEngine, frontendURL *url.URL) (spi.LogFrontend, error) {
 	switch frontendURL.Scheme {
-	case "syslog+tcp", "syslog+udp":
+	case "syslog+tcp", "syslog+udp", "syslog+tls":
 		return newSyslogServerFrontend(e, frontendURL)
 	case "api+http":
 		return newAPIFrontend(e, frontendURL)
 	case "ui+http":
 		return newUIFrontend(e, frontendURL)
+	case "metrics+http":
+		return newMetricsFrontend(e, frontendURL)
 	}
 	return nil, fmt.Errorf("Invalid frontend %s", frontendURL.Scheme)
 }
+
+// metricsLabel identifies a frontend in metrics, without its options.
+func metricsLabel(frontendURL *url.URL) string {
+	u := url.URL{Scheme: frontendURL.Scheme, Host: frontendURL.Host, Path: frontendURL.Path}
+	return u.String()
+}
@@ -0,0 +1,41 @@
+package frontend
+
+import (
+	"github.com/pierredavidbelanger/raftman/metrics"
+	"github.com/pierredavidbelanger/raftman/spi"
+	"net/http"
+	"net/url"
+)
+
+type metricsFrontend struct {
+	webFrontend
+}
+
+func newMetricsFrontend(e spi.LogEngine, frontendURL *url.URL) (*metricsFrontend, error) {
+	f := metricsFrontend{}
+	if err := initWebFrontend(e, frontendURL, &f.webFrontend); err != nil {
+		return nil, err
+	}
+	if f.path == "" {
+		f.path = "/metrics"
+	}
+	return &f, nil
+}
+
+func (f *metricsFrontend) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(f.path, f.handleMetrics)
+	return f.startHandler(mux)
+}
+
+func (f *metricsFrontend) Close() error {
+	return f.close()
+}
+
+func (f *metricsFrontend) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.WriteText(w); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
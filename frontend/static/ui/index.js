@@ -5,6 +5,26 @@ webix.ready(function () {
         return tsFormat(new Date(s));
     };
 
+    var escapeHTML = function (s) {
+        return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;").replace(/"/g, "&quot;");
+    };
+
+    // Matches are ranges of characters (not UTF-16 code units)
+    var messageTemplate = function (obj) {
+        if (!obj.Matches) {
+            return escapeHTML(obj.Message);
+        }
+        var chars = Array.from(obj.Message);
+        var html = "";
+        var pos = 0;
+        $.each(obj.Matches, function (_, m) {
+            html += escapeHTML(chars.slice(pos, m.Start).join(""));
+            html += "<mark>" + escapeHTML(chars.slice(m.Start, m.End).join("")) + "</mark>";
+            pos = m.End;
+        });
+        return html + escapeHTML(chars.slice(pos).join(""));
+    };
+
     webix.ui({
         rows: [
             {
@@ -14,7 +34,7 @@ webix.ready(function () {
                     {view: "button", type: "image", id: "home", image: "logo-32.png", width: 50},
                     {view: "datepicker", id: "fromTimestamp", timepicker: true, width: 200},
                     {view: "datepicker", id: "toTimestamp", timepicker: true, width: 200},
-                    {view: "text", id: "message", width: 300},
+                    {view: "text", id: "message", width: 300, placeholder: "host:web-* severity:<=err \"connection reset\" -healthcheck"},
                     {view: "checkbox", id: "follow", label: "Follow", value: true, width: 100},
                     {view: "button", id: "prevPage", value: "<<", width: 50},
                     {view: "button", id: "nextPage", value: ">>", width: 50}
@@ -43,7 +63,7 @@ webix.ready(function () {
                             {id: "Timestamp", header: "Timestamp", width: 175, format: tsFormatter},
                             {id: "Hostname", header: "Hostname", width: 150},
                             {id: "Application", header: "Application", width: 150},
-                            {id: "Message", header: "Message", fillspace: true}
+                            {id: "Message", header: "Message", fillspace: true, template: messageTemplate}
                         ],
                         data: []
                     }
@@ -76,9 +96,12 @@ webix.ready(function () {
     };
 
     var queryListRequest = {
-        Limit: 50
+        Limit: 50,
+        Highlight: true
     };
 
+    var queryListResponse = {};
+
     var autoUpdateEnabled = true;
 
     var updateStat = function () {
@@ -122,6 +145,7 @@ webix.ready(function () {
 
     var updateList = function () {
         return post("api/list", queryListRequest).done(function (data) {
+            queryListResponse = data;
             queryList.clearAll();
             if (data.Entries) {
                 data.Entries = data.Entries.reverse();
@@ -150,36 +174,36 @@ webix.ready(function () {
 
     fromTimestamp.attachEvent("onChange", function (value) {
         queryStatRequest.FromTimestamp = queryListRequest.FromTimestamp = value;
-        queryListRequest.Offset = 0;
+        queryListRequest.Cursor = null;
         updateStat();
     });
 
     toTimestamp.attachEvent("onChange", function (value) {
         queryStatRequest.ToTimestamp = queryListRequest.ToTimestamp = value;
-        queryListRequest.Offset = 0;
+        queryListRequest.Cursor = null;
         updateStat();
     });
 
     message.attachEvent("onChange", function (value) {
-        queryStatRequest.Message = queryListRequest.Message = value;
-        queryListRequest.Offset = 0;
+        queryStatRequest.Query = queryListRequest.Query = value;
+        queryListRequest.Cursor = null;
         updateStat();
     });
 
     follow.attachEvent("onChange", function (value) {
         autoUpdateEnabled = value;
         if (value === true) {
-            queryListRequest.Offset = 0;
+            queryListRequest.Cursor = null;
             updateStat();
         }
     });
 
     prevPage.attachEvent("onItemClick", function () {
-        follow.setValue(false);
-        if (!queryListRequest.Offset) {
-            queryListRequest.Offset = 0;
+        if (!queryListResponse.NextCursor) {
+            return;
         }
-        queryListRequest.Offset += queryListRequest.Limit;
+        follow.setValue(false);
+        queryListRequest.Cursor = queryListResponse.NextCursor;
         updateList();
     });
 
@@ -187,15 +211,12 @@ webix.ready(function () {
         if (follow.getValue()) {
             follow.setValue(false);
         }
-        if (!queryListRequest.Offset) {
-            queryListRequest.Offset = 0;
-        }
-        queryListRequest.Offset -= queryListRequest.Limit;
-        if (queryListRequest.Offset <= 0) {
-            queryListRequest.Offset = 0;
-            follow.setValue(true);
-        } else {
+        if (queryListResponse.PrevCursor) {
+            queryListRequest.Cursor = queryListResponse.PrevCursor;
             updateList();
+        } else {
+            queryListRequest.Cursor = null;
+            follow.setValue(true);
         }
     });
 
@@ -207,7 +228,7 @@ webix.ready(function () {
                 queryListRequest.Application = stat.Application !== "*" ? stat.Application : null;
             }
         }
-        queryListRequest.Offset = 0;
+        queryListRequest.Cursor = null;
         updateList();
     });
 
@@ -1,12 +1,18 @@
 package frontend
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/metrics"
 	"github.com/pierredavidbelanger/raftman/spi"
 	"github.com/pierredavidbelanger/raftman/utils"
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/url"
 	"strings"
 	"sync"
@@ -19,7 +25,13 @@ type syslogServerFrontend struct {
 	logsQ  syslog.LogPartsChannel
 	stopQ  chan *sync.Cond
 	format format.Format
-	server *syslog.Server
+	server syslogServer
+	listen func() error
+
+	insertErrors *metrics.Counter
+
+	shutdownTimeout time.Duration
+	deadline        time.Time
 }
 
 func newSyslogServerFrontend(e spi.LogEngine, frontendURL *url.URL) (*syslogServerFrontend, error) {
@@ -28,7 +40,22 @@ func newSyslogServerFrontend(e spi.LogEngine, frontendURL *url.URL) (*syslogServ
 		return nil, fmt.Errorf("Empty host in frontend URL '%s'", frontendURL)
 	}
 
-	syslogFormat, err := utils.GetSyslogFormatQueryParam(frontendURL, "format", syslog.RFC5424)
+	scheme := strings.ToLower(frontendURL.Scheme)
+
+	params := []string{"format", "queueSize", "timeout", "shutdownTimeout"}
+	if scheme == "syslog+tls" {
+		params = append(params, "cert", "key", "clientCA", "handshakeTimeout")
+	}
+	if err := utils.CheckQueryParams(frontendURL, params...); err != nil {
+		return nil, err
+	}
+
+	// RFC5425 frames the messages by octet counting, which AUTOMATIC detects
+	var defaultFormat format.Format = syslog.RFC5424
+	if scheme == "syslog+tls" {
+		defaultFormat = syslog.Automatic
+	}
+	syslogFormat, err := utils.GetSyslogFormatQueryParam(frontendURL, "format", defaultFormat)
 	if err != nil {
 		return nil, err
 	}
@@ -43,8 +70,14 @@ func newSyslogServerFrontend(e spi.LogEngine, frontendURL *url.URL) (*syslogServ
 		return nil, err
 	}
 
+	shutdownTimeout, err := utils.GetDurationQueryParam(frontendURL, "shutdownTimeout", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
 	f := syslogServerFrontend{}
 	f.e = e
+	f.shutdownTimeout = shutdownTimeout
 
 	logsQ := make(syslog.LogPartsChannel, queueSize)
 	f.logsQ = logsQ
@@ -54,22 +87,115 @@ func newSyslogServerFrontend(e spi.LogEngine, frontendURL *url.URL) (*syslogServ
 
 	f.format = syslogFormat
 
+	f.insertErrors = metrics.GetCounter("raftman_frontend_insert_errors_total", "Number of messages a frontend failed to insert in the backend.", "frontend", metricsLabel(frontendURL))
+
+	handler := &syslogHandler{
+		logsQ:       logsQ,
+		received:    metrics.GetCounter("raftman_frontend_received_total", "Number of messages received by a frontend.", "frontend", metricsLabel(frontendURL)),
+		parseErrors: metrics.GetCounter("raftman_frontend_parse_errors_total", "Number of messages a frontend failed to parse.", "frontend", metricsLabel(frontendURL)),
+	}
+	metrics.SetGaugeFunc("raftman_frontend_queue_length", "Number of messages waiting in a frontend queue.",
+		func() float64 { return float64(len(logsQ)) }, "frontend", metricsLabel(frontendURL))
+
+	// The address is only taken on start, so that a frontend can be
+	// created, and its options checked, while the one it replaces runs
+	if scheme == "syslog+tls" {
+		handshakeTimeout, err := utils.GetDurationQueryParam(frontendURL, "handshakeTimeout", 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if handshakeTimeout <= 0 {
+			return nil, fmt.Errorf("Invalid handshakeTimeout '%s', must be positive", handshakeTimeout)
+		}
+		config, err := newTLSConfig(frontendURL)
+		if err != nil {
+			return nil, err
+		}
+		server := &tlsServer{config: config, format: syslogFormat, handler: handler, timeout: timeout, handshakeTimeout: handshakeTimeout}
+		f.server = server
+		f.listen = func() error { return server.listen(frontendURL.Host) }
+		return &f, nil
+	}
+
 	server := syslog.NewServer()
 	server.SetFormat(syslogFormat)
 	server.SetTimeout(int64(timeout.Seconds() * 1000))
-	server.SetHandler(syslog.NewChannelHandler(logsQ))
-	switch strings.ToLower(frontendURL.Scheme) {
-	case "syslog+tcp":
-		err = server.ListenTCP(frontendURL.Host)
-	case "syslog+udp":
-		err = server.ListenUDP(frontendURL.Host)
+	server.SetHandler(handler)
+	f.server = server
+	if scheme == "syslog+udp" {
+		f.listen = func() error { return server.ListenUDP(frontendURL.Host) }
+	} else {
+		f.listen = func() error { return server.ListenTCP(frontendURL.Host) }
 	}
+
+	return &f, nil
+}
+
+// syslogServer is a go-syslog server, or the tlsServer.
+type syslogServer interface {
+	Boot() error
+	Kill() error
+	Wait()
+}
+
+// syslogHandler queues the parsed messages, like the go-syslog channel
+// handler, while counting them.
+type syslogHandler struct {
+	logsQ       syslog.LogPartsChannel
+	received    *metrics.Counter
+	parseErrors *metrics.Counter
+}
+
+func (h *syslogHandler) Handle(logParts format.LogParts, msgLen int64, err error) {
+	h.received.Inc()
 	if err != nil {
-		return nil, err
+		h.parseErrors.Inc()
 	}
-	f.server = server
+	h.logsQ <- logParts
+}
 
-	return &f, nil
+func newTLSConfig(frontendURL *url.URL) (*tls.Config, error) {
+
+	q := frontendURL.Query()
+
+	certFile := q.Get("cert")
+	keyFile := q.Get("key")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("Both cert and key must be set in frontend URL '%s'", frontendURL)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load certificate '%s' and key '%s': %s", certFile, keyFile, err)
+	}
+
+	config := tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile := q.Get("clientCA"); clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read client CA '%s': %s", clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificate found in client CA '%s'", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &config, nil
+}
+
+// tlsPeerName returns the peer certificate CN, or an empty string for a peer
+// without a certificate (the handshake already rejected those if a client CA
+// was configured).
+func tlsPeerName(tlsConn *tls.Conn) string {
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
 }
 
 func (f *syslogServerFrontend) Start() error {
@@ -77,7 +203,12 @@ func (f *syslogServerFrontend) Start() error {
 	_, b := f.e.GetBackend()
 	f.b = b
 
-	err := f.server.Boot()
+	err := f.listen()
+	if err != nil {
+		return err
+	}
+
+	err = f.server.Boot()
 	if err != nil {
 		return err
 	}
@@ -89,30 +220,78 @@ func (f *syslogServerFrontend) Start() error {
 
 func (f *syslogServerFrontend) Close() error {
 
+	f.deadline = time.Now().Add(f.shutdownTimeout)
+
+	// Stop receiving first, then wait for the messages being received to
+	// be queued, so that the queue can be drained into the backend
+	err := f.server.Kill()
+	done := make(chan bool)
+	go func() {
+		f.server.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(f.deadline)):
+	}
+
 	cond := sync.NewCond(&sync.Mutex{})
 	cond.L.Lock()
 	f.stopQ <- cond
 	cond.Wait()
 	cond.L.Unlock()
 
-	return f.server.Kill()
+	return err
 }
 
 func (f *syslogServerFrontend) run() {
 	for {
 		select {
 		case logParts := <-f.logsQ:
-			f.b.Insert(&api.InsertRequest{Entry: f.toLogEntry(logParts)})
+			f.insert(logParts)
 		case cond := <-f.stopQ:
+			f.drain()
 			cond.Broadcast()
 			return
 		}
 	}
 }
 
+// drain sends the messages still queued to the backend, until the deadline.
+func (f *syslogServerFrontend) drain() {
+	flushed, failed := 0, 0
+	for len(f.logsQ) > 0 && time.Now().Before(f.deadline) {
+		if f.insert(<-f.logsQ) {
+			flushed++
+		} else {
+			failed++
+		}
+	}
+	log.Printf("Flushed %d queued messages from the frontend, dropped %d", flushed, failed+len(f.logsQ))
+}
+
+// insert sends the message to the backend, and reports whether it took it.
+func (f *syslogServerFrontend) insert(logParts format.LogParts) bool {
+	if _, err := f.b.Insert(&api.InsertRequest{Entry: f.toLogEntry(logParts)}); err != nil {
+		log.Printf("Unable to insert: %s", err)
+		f.insertErrors.Inc()
+		return false
+	}
+	return true
+}
+
 func (f *syslogServerFrontend) toLogEntry(logParts format.LogParts) *api.LogEntry {
 	e := api.LogEntry{}
-	switch f.format {
+	if val, ok := logParts["priority"].(int); ok {
+		e.Priority = val
+	}
+	if val, ok := logParts["facility"].(int); ok {
+		e.Facility = val
+	}
+	if val, ok := logParts["severity"].(int); ok {
+		e.Severity = val
+	}
+	switch detectedFormat(f.format, logParts) {
 	case syslog.RFC3164:
 		if val, ok := logParts["timestamp"].(time.Time); ok {
 			e.Timestamp = val
@@ -122,6 +301,17 @@ func (f *syslogServerFrontend) toLogEntry(logParts format.LogParts) *api.LogEntr
 		if val, ok := logParts["hostname"].(string); ok {
 			e.Hostname = val
 		}
+		if e.Hostname == "" {
+			// go-syslog only falls back to the client address when the
+			// format is explicitly RFC3164, not when it was detected
+			if val, ok := logParts["client"].(string); ok {
+				if host, _, err := net.SplitHostPort(val); err == nil {
+					e.Hostname = host
+				} else {
+					e.Hostname = val
+				}
+			}
+		}
 		if val, ok := logParts["tag"].(string); ok {
 			e.Application = val
 		}
@@ -143,6 +333,31 @@ func (f *syslogServerFrontend) toLogEntry(logParts format.LogParts) *api.LogEntr
 		if val, ok := logParts["message"].(string); ok {
 			e.Message = val
 		}
+		if val, ok := logParts["proc_id"].(string); ok && val != "-" {
+			e.ProcID = val
+		}
+		if val, ok := logParts["msg_id"].(string); ok && val != "-" {
+			e.MsgID = val
+		}
+		if val, ok := logParts["structured_data"].(string); ok && val != "-" {
+			e.StructuredData = val
+		}
 	}
 	return &e
 }
+
+// detectedFormat returns the format whose fields are present in logParts.
+// RFC6587 frames carry an RFC5424 message, and AUTOMATIC may yield either
+// RFC3164 or RFC5424 depending on each message.
+func detectedFormat(f format.Format, logParts format.LogParts) format.Format {
+	switch f {
+	case syslog.RFC6587:
+		return syslog.RFC5424
+	case syslog.Automatic:
+		if _, ok := logParts["app_name"]; ok {
+			return syslog.RFC5424
+		}
+		return syslog.RFC3164
+	}
+	return f
+}
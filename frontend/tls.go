@@ -0,0 +1,156 @@
+package frontend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"net"
+	"sync"
+	"time"
+)
+
+// tlsServer receives syslog messages over TLS (RFC5425). go-syslog does the
+// handshake of each connection in its accept loop, without a deadline, so a
+// single client that never completes its handshake holds back all the
+// others: here each connection does its own, within handshakeTimeout.
+type tlsServer struct {
+	config           *tls.Config
+	format           format.Format
+	handler          syslog.Handler
+	timeout          time.Duration
+	handshakeTimeout time.Duration
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	killed   bool
+	wg       sync.WaitGroup
+}
+
+func (s *tlsServer) listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.conns = make(map[net.Conn]bool)
+	return nil
+}
+
+func (s *tlsServer) Boot() error {
+	s.wg.Add(1)
+	go s.accept()
+	return nil
+}
+
+// Kill stops accepting connections, and stops reading the open ones once
+// what they already received is handled.
+func (s *tlsServer) Kill() error {
+	s.mu.Lock()
+	s.killed = true
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+func (s *tlsServer) Wait() {
+	s.wg.Wait()
+}
+
+func (s *tlsServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isKilled() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *tlsServer) isKilled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.killed
+}
+
+func (s *tlsServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.killed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *tlsServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *tlsServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+
+	tlsConn := tls.Server(conn, s.config)
+	defer tlsConn.Close()
+	tlsConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return
+	}
+	tlsConn.SetWriteDeadline(time.Time{})
+	tlsPeer := tlsPeerName(tlsConn)
+
+	client := conn.RemoteAddr().String()
+	scanner := bufio.NewScanner(tlsConn)
+	if sf := s.format.GetSplitFunc(); sf != nil {
+		scanner.Split(sf)
+	}
+	for {
+		s.setReadDeadline(tlsConn)
+		if !scanner.Scan() {
+			return
+		}
+		s.parse([]byte(scanner.Text()), client, tlsPeer)
+	}
+}
+
+// setReadDeadline sets the read deadline of the connection to the timeout,
+// if any, unless the server is killed, so that it does not undo Kill.
+func (s *tlsServer) setReadDeadline(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.killed:
+		conn.SetReadDeadline(time.Now())
+	case s.timeout > 0:
+		conn.SetReadDeadline(time.Now().Add(s.timeout))
+	default:
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// parse parses a message, and passes it to the handler, like go-syslog.
+func (s *tlsServer) parse(line []byte, client, tlsPeer string) {
+	parser := s.format.GetParser(line)
+	err := parser.Parse()
+	logParts := parser.Dump()
+	logParts["client"] = client
+	logParts["tls_peer"] = tlsPeer
+	s.handler.Handle(logParts, int64(len(line)), err)
+}
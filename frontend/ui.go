@@ -27,6 +27,10 @@ func (f *uiFrontend) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc(f.path+"api/stat", f.api.handleStat)
 	mux.HandleFunc(f.path+"api/list", f.api.handleList)
+	mux.HandleFunc(f.path+"api/histogram", f.api.handleHistogram)
+	mux.HandleFunc(f.path+"api/context", f.api.handleContext)
+	mux.HandleFunc(f.path+"api/tail", f.api.handleTail)
+	mux.HandleFunc(f.path+"api/export", f.api.handleExport)
 	var useLocal bool
 	if _, err := os.Stat("frontend/static/ui/index.html"); err == nil {
 		useLocal = true
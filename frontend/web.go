@@ -2,18 +2,21 @@ package frontend
 
 import (
 	"fmt"
+	"github.com/pierredavidbelanger/raftman/metrics"
 	"github.com/pierredavidbelanger/raftman/spi"
+	"github.com/pierredavidbelanger/raftman/utils"
 	"net"
 	"net/http"
 	"net/url"
 )
 
 type webFrontend struct {
-	e    spi.LogEngine
-	b    spi.LogBackend
-	addr string
-	path string
-	s    *http.Server
+	e        spi.LogEngine
+	b        spi.LogBackend
+	addr     string
+	path     string
+	s        *http.Server
+	requests *metrics.Counter
 }
 
 func initWebFrontend(e spi.LogEngine, frontendURL *url.URL, f *webFrontend) error {
@@ -21,8 +24,12 @@ func initWebFrontend(e spi.LogEngine, frontendURL *url.URL, f *webFrontend) erro
 	if frontendURL.Host == "" {
 		return fmt.Errorf("Empty host in frontend URL '%s'", frontendURL)
 	}
+	if err := utils.CheckQueryParams(frontendURL); err != nil {
+		return err
+	}
 	f.addr = frontendURL.Host
 	f.path = frontendURL.Path
+	f.requests = metrics.GetCounter("raftman_frontend_http_requests_total", "Number of HTTP requests received by a frontend.", "frontend", metricsLabel(frontendURL))
 	return nil
 }
 
@@ -31,7 +38,10 @@ func (f *webFrontend) startHandler(h http.Handler) error {
 	_, b := f.e.GetBackend()
 	f.b = b
 
-	f.s = &http.Server{Addr: f.addr, Handler: h}
+	f.s = &http.Server{Addr: f.addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests.Inc()
+		h.ServeHTTP(w, r)
+	})}
 
 	ln, err := net.Listen("tcp", f.addr)
 	if err != nil {
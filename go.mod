@@ -4,8 +4,8 @@ go 1.13
 
 require (
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/mattn/go-sqlite3 v0.0.0-20170529145928-83772a7051f5
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/mcuadros/go-syslog.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used for latencies.
+var DefaultBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type gaugeFunc func() float64
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]interface{}
+}
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Default is the registry all raftman components report to.
+var Default = NewRegistry()
+
+// GetCounter returns the counter with the given name and labels (as
+// alternating keys and values), creating it if needed.
+func GetCounter(name, help string, labels ...string) *Counter {
+	return Default.get(name, help, "counter", labels, func() interface{} {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// GetHistogram returns the histogram with the given name and labels (as
+// alternating keys and values), creating it with buckets if needed.
+func GetHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.get(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	}).(*Histogram)
+}
+
+// SetGaugeFunc registers fn to be called at each scrape to get the value of
+// the gauge with the given name and labels (as alternating keys and values).
+// It replaces any function previously registered for the same gauge.
+func SetGaugeFunc(name, help string, fn func() float64, labels ...string) {
+	Default.set(name, help, "gauge", labels, gaugeFunc(fn))
+}
+
+// WriteText writes all the metrics in the Prometheus text exposition format.
+func WriteText(w io.Writer) error {
+	return Default.WriteText(w)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", labels[i], quoteLabelValue(labels[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (r *Registry) family(name, help, kind string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]interface{})}
+		r.families[name] = f
+	}
+	return f
+}
+
+func (r *Registry) get(name, help, kind string, labels []string, create func() interface{}) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, help, kind)
+	key := formatLabels(labels)
+	m, ok := f.series[key]
+	if !ok {
+		m = create()
+		f.series[key] = m
+	}
+	return m
+}
+
+func (r *Registry) set(name, help, kind string, labels []string, m interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name, help, kind).series[formatLabels(labels)] = m
+}
+
+func withLabel(labels, name, value string) string {
+	l := fmt.Sprintf("%s=%s", name, quoteLabelValue(value))
+	if labels == "" {
+		return l
+	}
+	return labels + "," + l
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabelValue quotes a label value the way the text format wants it:
+// only backslashes, double quotes and line feeds are escaped, and invalid
+// UTF-8 is replaced, as the values may come from the syslog messages.
+func quoteLabelValue(value string) string {
+	return `"` + labelValueEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeSample(w io.Writer, name, labels string, v string) error {
+	if labels != "" {
+		_, err := fmt.Fprintf(w, "%s{%s} %s\n", name, labels, v)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, v)
+	return err
+}
+
+func (r *Registry) WriteText(w io.Writer) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var err error
+			switch m := f.series[key].(type) {
+			case *Counter:
+				err = writeSample(w, f.name, key, strconv.FormatUint(m.Value(), 10))
+			case gaugeFunc:
+				err = writeSample(w, f.name, key, formatFloat(m()))
+			case *Histogram:
+				err = m.writeText(w, f.name, key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *Histogram) writeText(w io.Writer, name, labels string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if err := writeSample(w, name+"_bucket", withLabel(labels, "le", formatFloat(le)), strconv.FormatUint(h.counts[i], 10)); err != nil {
+			return err
+		}
+	}
+	if err := writeSample(w, name+"_bucket", withLabel(labels, "le", "+Inf"), strconv.FormatUint(h.count, 10)); err != nil {
+		return err
+	}
+	if err := writeSample(w, name+"_sum", labels, formatFloat(h.sum)); err != nil {
+		return err
+	}
+	return writeSample(w, name+"_count", labels, strconv.FormatUint(h.count, 10))
+}
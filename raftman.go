@@ -4,35 +4,80 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/pierredavidbelanger/raftman/config"
 	"github.com/pierredavidbelanger/raftman/engine"
 	"log"
 	"net/url"
+	"os"
 )
 
 func main() {
 
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{"rehydrate": rehydrate, "backup": backup, "restore": restore}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var frontendArgs URLValues
 	var backendArgs URLValues
+	var configFile string
 
 	flag.Var(&frontendArgs, "frontend", "Frontend URLs")
 	flag.Var(&backendArgs, "backend", "Backend URL")
+	flag.StringVar(&configFile, "config", "", "Config file (YAML)")
 
 	flag.Parse()
 
-	if len(backendArgs) == 0 {
-		backendArgs = append(backendArgs, mustParseURL("sqlite:///var/lib/raftman/logs.db"))
-	} else if len(backendArgs) > 1 {
-		log.Fatal("At most one backend must be defined")
+	if configFile != "" && (len(backendArgs) > 0 || len(frontendArgs) > 0) {
+		log.Fatal("The config file can not be combined with -backend or -frontend")
 	}
 
-	if len(frontendArgs) == 0 {
-		frontendArgs = append(frontendArgs, mustParseURL("syslog+udp://:514"))
-		frontendArgs = append(frontendArgs, mustParseURL("syslog+tcp://:5514"))
-		frontendArgs = append(frontendArgs, mustParseURL("api+http://:8181/api/"))
-		frontendArgs = append(frontendArgs, mustParseURL("ui+http://:8282/"))
+	// load is called at startup, and again on SIGHUP to reload the config
+	load := func() (*url.URL, []*url.URL, error) {
+
+		backendURLs := backendArgs
+		frontendURLs := frontendArgs
+
+		if configFile != "" {
+			c, err := config.Load(configFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			backendURL, err := c.BackendURL()
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid config file '%s': %s", configFile, err)
+			}
+			if backendURL != nil {
+				backendURLs = []*url.URL{backendURL}
+			}
+			frontendURLs, err = c.FrontendURLs()
+			if err != nil {
+				return nil, nil, fmt.Errorf("Invalid config file '%s': %s", configFile, err)
+			}
+		}
+
+		if len(backendURLs) == 0 {
+			backendURLs = append(backendURLs, mustParseURL("sqlite:///var/lib/raftman/logs.db"))
+		} else if len(backendURLs) > 1 {
+			return nil, nil, fmt.Errorf("At most one backend must be defined")
+		}
+
+		if len(frontendURLs) == 0 {
+			frontendURLs = append(frontendURLs, mustParseURL("syslog+udp://:514"))
+			frontendURLs = append(frontendURLs, mustParseURL("syslog+tcp://:5514"))
+			frontendURLs = append(frontendURLs, mustParseURL("api+http://:8181/api/"))
+			frontendURLs = append(frontendURLs, mustParseURL("ui+http://:8282/"))
+		}
+
+		return backendURLs[0], frontendURLs, nil
 	}
 
-	e, err := engine.NewEngine(backendArgs[0], frontendArgs)
+	e, err := engine.NewEngine(load)
 	if err != nil {
 		log.Fatalf("Unable to create engine: %s", err)
 	}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pierredavidbelanger/raftman/api"
+	"github.com/pierredavidbelanger/raftman/backend"
+	"io"
+	"log"
+	"os"
+)
+
+// rehydrate inserts the entries of archive files back into a backend, ie:
+//
+//	raftman rehydrate -backend sqlite:///var/lib/raftman/restored.db logs-2017-06-01.jsonl.gz
+func rehydrate(args []string) error {
+
+	var backendArgs URLValues
+
+	fs := flag.NewFlagSet("rehydrate", flag.ExitOnError)
+	fs.Var(&backendArgs, "backend", "Backend URL")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rehydrate -backend URL ARCHIVE...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if len(backendArgs) != 1 {
+		return fmt.Errorf("Exactly one backend must be defined")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("At least one archive must be given")
+	}
+
+	b, err := backend.NewBackend(nil, backendArgs[0])
+	if err != nil {
+		return fmt.Errorf("Unable to create backend '%s': %s", backendArgs[0], err)
+	}
+	if err = b.Start(); err != nil {
+		return fmt.Errorf("Unable to start backend '%s': %s", backendArgs[0], err)
+	}
+
+	for _, path := range fs.Args() {
+		var n int
+		n, err = rehydrateArchive(b.Insert, path)
+		if err == nil || n > 0 {
+			log.Printf("Rehydrated %d entries from '%s'", n, path)
+		}
+		if err != nil {
+			err = fmt.Errorf("Unable to rehydrate '%s': %s", path, err)
+			break
+		}
+	}
+
+	// The entries still queued are inserted on close
+	if closeErr := b.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rehydrateArchive inserts the entries of an archive file, a batch at a
+// time, and returns how many it read.
+func rehydrateArchive(insert func(*api.InsertRequest) (*api.InsertResponse, error), path string) (int, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	dec := json.NewDecoder(gz)
+	req := api.InsertRequest{}
+	for {
+		entry := api.LogEntry{}
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// An archive cut short still has its first entries
+			_, insertErr := insert(&req)
+			if insertErr == nil {
+				n += len(req.Entries)
+			}
+			return n, err
+		}
+		req.Entries = append(req.Entries, &entry)
+		if len(req.Entries) == 256 {
+			if _, err = insert(&req); err != nil {
+				return n, err
+			}
+			n += len(req.Entries)
+			req.Entries = nil
+		}
+	}
+
+	if _, err = insert(&req); err != nil {
+		return n, err
+	}
+	return n + len(req.Entries), nil
+}
@@ -1,6 +1,7 @@
 package spi
 
 import (
+	"context"
 	"github.com/pierredavidbelanger/raftman/api"
 	"io"
 	"net/url"
@@ -9,9 +10,21 @@ import (
 type LogBackend interface {
 	Start() error
 	io.Closer
+	Reconfigure(*url.URL) error
 	Insert(*api.InsertRequest) (*api.InsertResponse, error)
-	QueryStat(*api.QueryRequest) (*api.QueryStatResponse, error)
-	QueryList(*api.QueryRequest) (*api.QueryListResponse, error)
+	QueryStat(context.Context, *api.QueryRequest) (*api.QueryStatResponse, error)
+	QueryList(context.Context, *api.QueryRequest) (*api.QueryListResponse, error)
+	QueryHistogram(context.Context, *api.QueryRequest) (*api.QueryHistogramResponse, error)
+	QueryContext(context.Context, *api.QueryContextRequest) (*api.QueryContextResponse, error)
+	Tail(*api.QueryRequest) (LogTail, error)
+	Export(context.Context, *api.QueryRequest, func(*api.LogEntry) error) error
+	ListArchives(context.Context) (*api.ArchiveListResponse, error)
+	Backup(context.Context, *api.BackupRequest) (*api.BackupResponse, error)
+}
+
+type LogTail interface {
+	Entries() <-chan *api.LogEntry
+	io.Closer
 }
 
 type LogFrontend interface {
@@ -22,6 +35,7 @@ type LogFrontend interface {
 type LogEngine interface {
 	Start() error
 	Wait() error
+	Reload() error
 	io.Closer
 	GetBackend() (*url.URL, LogBackend)
 	GetFrontends() ([]*url.URL, []LogFrontend)
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Size int64
+
+const (
+	KB Size = 1 << (10 * (iota + 1))
+	MB
+	GB
+	TB
+)
+
+func (s Size) String() string {
+	switch {
+	case s >= TB && s%TB == 0:
+		return fmt.Sprintf("%dTB", s/TB)
+	case s >= GB && s%GB == 0:
+		return fmt.Sprintf("%dGB", s/GB)
+	case s >= MB && s%MB == 0:
+		return fmt.Sprintf("%dMB", s/MB)
+	case s >= KB && s%KB == 0:
+		return fmt.Sprintf("%dKB", s/KB)
+	}
+	return fmt.Sprintf("%dB", int64(s))
+}
+
+var sizeRE *regexp.Regexp = regexp.MustCompile(`^(\d+)(B|KB|MB|GB|TB)?$`)
+
+// ParseSize parses a size in bytes, with an optional (binary) unit
+// suffix (ie: 512MB, 2GB).
+func ParseSize(s string) (Size, error) {
+	sm := sizeRE.FindStringSubmatch(strings.ToUpper(s))
+	if sm == nil {
+		return 0, fmt.Errorf("invalid (B|KB|MB|GB|TB) size '%s'", s)
+	}
+	n, err := strconv.ParseInt(sm[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid (B|KB|MB|GB|TB) size '%s'", s)
+	}
+	switch sm[2] {
+	case "KB":
+		return Size(n) * KB, nil
+	case "MB":
+		return Size(n) * MB, nil
+	case "GB":
+		return Size(n) * GB, nil
+	case "TB":
+		return Size(n) * TB, nil
+	}
+	return Size(n), nil
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var severityNames = map[string]int{
+	"emerg":     0,
+	"emergency": 0,
+	"panic":     0,
+	"alert":     1,
+	"crit":      2,
+	"critical":  2,
+	"err":       3,
+	"error":     3,
+	"warning":   4,
+	"warn":      4,
+	"notice":    5,
+	"info":      6,
+	"debug":     7,
+}
+
+var facilityNames = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"ntp":      12,
+	"security": 13,
+	"console":  14,
+	"clock":    15,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// ParseSeverity parses a syslog severity, either by its name (ie: warning)
+// or by its numerical code (ie: 4).
+func ParseSeverity(s string) (int, error) {
+	return parseSyslogCode(s, severityNames, 7, "severity")
+}
+
+// ParseFacility parses a syslog facility, either by its name (ie: auth)
+// or by its numerical code (ie: 4).
+func ParseFacility(s string) (int, error) {
+	return parseSyslogCode(s, facilityNames, 23, "facility")
+}
+
+func parseSyslogCode(s string, names map[string]int, max int, what string) (int, error) {
+	if n, ok := names[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("invalid syslog %s '%s'", what, s)
+	}
+	return n, nil
+}
@@ -5,17 +5,45 @@ import (
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// CheckQueryParams returns an error if u has a query param that is not one
+// of the given names, so typos in options do not go unnoticed.
+func CheckQueryParams(u *url.URL, names ...string) error {
+	for name := range u.Query() {
+		valid := false
+		for _, n := range names {
+			if name == n {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			if len(names) == 0 {
+				return fmt.Errorf("Unknown option '%s' (no option is supported)", name)
+			}
+			sorted := append([]string{}, names...)
+			sort.Strings(sorted)
+			return fmt.Errorf("Unknown option '%s' (valid options are %s)", name, strings.Join(sorted, ", "))
+		}
+	}
+	return nil
+}
+
 func GetIntQueryParam(u *url.URL, name string, defaultValue int) (int, error) {
 	s := u.Query().Get(name)
 	if s == "" {
 		return defaultValue, nil
 	}
-	return strconv.Atoi(s)
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s', must be an integer", name, s)
+	}
+	return v, nil
 }
 
 func GetDurationQueryParam(u *url.URL, name string, defaultValue time.Duration) (time.Duration, error) {
@@ -23,7 +51,11 @@ func GetDurationQueryParam(u *url.URL, name string, defaultValue time.Duration)
 	if s == "" {
 		return defaultValue, nil
 	}
-	return time.ParseDuration(s)
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s', must be a duration (ie: 5s, 1m30s)", name, s)
+	}
+	return v, nil
 }
 
 func GetRetentionQueryParam(u *url.URL, name string, defaultValue Retention) (Retention, error) {
@@ -31,7 +63,23 @@ func GetRetentionQueryParam(u *url.URL, name string, defaultValue Retention) (Re
 	if s == "" {
 		return defaultValue, nil
 	}
-	return ParseRetention(s)
+	v, err := ParseRetention(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", name, err)
+	}
+	return v, nil
+}
+
+func GetSizeQueryParam(u *url.URL, name string, defaultValue Size) (Size, error) {
+	s := u.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	v, err := ParseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", name, err)
+	}
+	return v, nil
 }
 
 func GetSyslogFormatQueryParam(u *url.URL, name string, defaultValue format.Format) (format.Format, error) {
@@ -39,16 +87,15 @@ func GetSyslogFormatQueryParam(u *url.URL, name string, defaultValue format.Form
 	if s == "" {
 		return defaultValue, nil
 	}
-	// TODO: must support them in syslog.toLogEntry
 	switch strings.ToUpper(s) {
 	case "RFC3164":
 		return syslog.RFC3164, nil
 	case "RFC5424":
 		return syslog.RFC5424, nil
-		//case "RFC6587":
-		//	return syslog.RFC6587, nil
-		//case "AUTOMATIC":
-		//	return syslog.Automatic, nil
+	case "RFC6587":
+		return syslog.RFC6587, nil
+	case "AUTOMATIC":
+		return syslog.Automatic, nil
 	}
-	return nil, fmt.Errorf("Invalid syslog format %s", s)
+	return nil, fmt.Errorf("Invalid %s '%s', must be one of RFC3164, RFC5424, RFC6587 or AUTOMATIC", name, s)
 }